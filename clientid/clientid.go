@@ -0,0 +1,127 @@
+package clientid
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver works out the client host of a request. Forwarding headers are
+// only believed when the peer is one of the trusted proxies. A nil Resolver
+// trusts no proxy.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver returns a Resolver trusting the proxies in cidrs. Plain
+// addresses are accepted as single host networks.
+func NewResolver(cidrs []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy address %q", c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy CIDR %q: %v", c, err)
+		}
+		r.trusted = append(r.trusted, n)
+	}
+	return r, nil
+}
+
+// Trusted reports whether ip belongs to a trusted proxy
+func (r *Resolver) Trusted(ip net.IP) bool {
+	if r == nil || ip == nil {
+		return false
+	}
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Host returns the host part of a host:port address, IPv6 addresses
+// included, in canonical form. Addresses without a port are returned as is.
+func Host(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// forwardedFor returns the for= addresses of a Forwarded header, RFC 7239
+func forwardedFor(values []string) []string {
+	addrs := []string{}
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+					continue
+				}
+				addrs = append(addrs, strings.Trim(pair[4:], `"`))
+			}
+		}
+	}
+	return addrs
+}
+
+func splitList(values []string) []string {
+	addrs := []string{}
+	for _, v := range values {
+		for _, a := range strings.Split(v, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	return addrs
+}
+
+// Client returns the host of the client that made req
+func (r *Resolver) Client(req *http.Request) string {
+	peer := Host(req.RemoteAddr)
+	if !r.Trusted(net.ParseIP(peer)) {
+		return peer
+	}
+	chain := forwardedFor(req.Header["Forwarded"])
+	if len(chain) == 0 {
+		chain = splitList(req.Header["X-Forwarded-For"])
+	}
+	if len(chain) == 0 {
+		chain = splitList(req.Header["X-Real-Ip"])
+	}
+	// walk the chain from the proxy closest to us, the first address that
+	// isn't a trusted proxy is the client
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		host := Host(chain[i])
+		ip := net.ParseIP(host)
+		if ip == nil {
+			// obfuscated or unknown node, we can't go further
+			break
+		}
+		client = host
+		if !r.Trusted(ip) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,161 @@
+package clientid
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headerTimeout bounds how long we wait for a PROXY protocol header
+const headerTimeout = 5 * time.Second
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+type proxyListener struct {
+	net.Listener
+	resolver *Resolver
+}
+
+// NewProxyListener wraps l so connections from trusted proxies may start
+// with a PROXY protocol v1 or v2 header. The address in the header then
+// becomes the connection's remote address. Connections from other peers are
+// left untouched.
+func NewProxyListener(l net.Listener, r *Resolver) net.Listener {
+	return &proxyListener{Listener: l, resolver: r}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, resolver: l.resolver, reader: bufio.NewReader(c)}, nil
+}
+
+// proxyConn reads the PROXY header on first use, which happens in the
+// connection's own goroutine so a slow client doesn't stall Accept
+type proxyConn struct {
+	net.Conn
+	resolver *Resolver
+	reader   *bufio.Reader
+	once     sync.Once
+	remote   net.Addr
+	err      error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		if !c.resolver.Trusted(net.ParseIP(Host(c.remote.String()))) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		addr, err := readHeader(c.reader)
+		if err != nil {
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readHeader consumes a PROXY header if there is one. It returns the source
+// address, nil when the header carries none or there is no header.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	if b, err := r.Peek(len(v2Signature)); err == nil && bytes.Equal(b, v2Signature) {
+		return readV2(r)
+	}
+	if b, err := r.Peek(len(v1Prefix)); err == nil && bytes.Equal(b, v1Prefix) {
+		return readV1(r)
+	}
+	return nil, nil
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	// a v1 header is at most 107 bytes
+	line := make([]byte, 0, 107)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read PROXY header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == cap(line) {
+			return nil, fmt.Errorf("PROXY header too long")
+		}
+	}
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Malformed PROXY header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Malformed PROXY header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("Failed to read PROXY header: %v", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("Failed to read PROXY header: %v", err)
+	}
+	// LOCAL command, the proxy is talking for itself
+	if hdr[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("Short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("Short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// unix sockets and unspecified families carry no usable address
+	return nil, nil
+}
@@ -13,9 +13,84 @@ type Config struct {
 	FileConfig FileConfig
 }
 
+// URI is a resource of the config file, its uri alone or with its limits and
+// priority
+type URI struct {
+	URI string `yaml:"uri"`
+	// a resource with max_jobs jobs or max_series series gets no new jobs, 0
+	// means no limit
+	MaxJobs   int `yaml:"max_jobs"`
+	MaxSeries int `yaml:"max_series"`
+	// the tier of the resource, resources of higher priorities, 1, 2..., only
+	// get jobs when every resource of the better ones is down or full
+	Priority int `yaml:"priority"`
+}
+
+// UnmarshalYAML reads a URI from a plain uri or a mapping
+func (u *URI) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&u.URI); err == nil {
+		return nil
+	}
+	type plain URI
+	return unmarshal((*plain)(u))
+}
+
 type FileConfig struct {
 	Middleman struct {
 		Algorithm string `yaml:"algorithm"`
+		// AdminToken guards the admin API, with or without tenants
+		AdminToken string `yaml:"admin_token"`
+		Identity   struct {
+			Mode     string `yaml:"mode"`
+			Template string `yaml:"template"`
+		}
+		Affinity struct {
+			Level string `yaml:"level"`
+			Label string `yaml:"label"`
+		}
+		Delete struct {
+			// exact or prefix
+			Mode             string `yaml:"mode"`
+			BroadcastUnknown bool   `yaml:"broadcast_unknown"`
+		}
+		Client struct {
+			TrustedProxies []string `yaml:"trusted_proxies"`
+			ProxyProtocol  bool     `yaml:"proxy_protocol"`
+		}
+		Federate struct {
+			Enabled bool `yaml:"enabled"`
+		}
+		Validation struct {
+			Enabled bool `yaml:"enabled"`
+		}
+		// Replay keeps the last push of every job to replay it to the new
+		// resource of jobs that move
+		Replay struct {
+			Enabled        bool   `yaml:"enabled"`
+			MaxEntries     int    `yaml:"max_entries"`
+			MaxMemoryBytes int64  `yaml:"max_memory_bytes"`
+			SpillDir       string `yaml:"spill_dir"`
+		}
+		// Rebalance evens out the jobs of the resources every Interval when
+		// the skew, the difference between the busiest and idlest resource
+		// relative to the mean, exceeds Skew. Disabled when Skew is 0.
+		Rebalance struct {
+			Skew     float64       `yaml:"skew"`
+			Interval time.Duration `yaml:"interval"`
+		}
+		// Spool keeps the pushes resources fail to take in Dir and delivers
+		// them once the resource is back, disabled when Dir is empty
+		Spool struct {
+			Dir      string        `yaml:"dir"`
+			MaxBytes int64         `yaml:"max_bytes"`
+			MaxAge   time.Duration `yaml:"max_age"`
+		}
+		// Shutdown answers /-/ready with 503 for ReadyDelay on SIGINT or
+		// SIGTERM, then gives in-flight requests GracePeriod to complete
+		Shutdown struct {
+			ReadyDelay  time.Duration `yaml:"ready_delay"`
+			GracePeriod time.Duration `yaml:"grace_period"`
+		}
 	}
 	Resources struct {
 		Docker struct {
@@ -26,7 +101,56 @@ type FileConfig struct {
 			Label        string        `yaml:"label"`
 			Network      string        `yaml:"network"`
 		}
-		Uris []string `yaml:",flow"`
+		Uris []URI `yaml:",flow"`
+		// resources are polled every interval when it is set, those not
+		// answering within timeout get no new jobs
+		HealthCheck struct {
+			Interval time.Duration `yaml:"interval"`
+			Timeout  time.Duration `yaml:"timeout"`
+		} `yaml:"health_check"`
+		// resources added while running get their full share of new jobs
+		// only after WarmUp, 0 disables slow start
+		WarmUp time.Duration `yaml:"warm_up"`
+	}
+	// Pools are named sets of resources with their own balancer, the
+	// resources above belong to the default pool
+	Pools []struct {
+		Name      string `yaml:"name"`
+		Algorithm string `yaml:"algorithm"`
+		Uris      []URI  `yaml:",flow"`
+	}
+	// Tenants share middleman, each with its own pool, job quota and push
+	// rate. Tenants are disabled when the list is empty.
+	Tenants struct {
+		// header, path or token
+		IdentifyBy string `yaml:"identify_by"`
+		Header     string `yaml:"header"`
+		AdminToken string `yaml:"admin_token"`
+		List       []struct {
+			Name      string  `yaml:"name"`
+			Token     string  `yaml:"token"`
+			Pool      string  `yaml:"pool"`
+			MaxJobs   int     `yaml:"max_jobs"`
+			PushRate  float64 `yaml:"push_rate"`
+			PushBurst int     `yaml:"push_burst"`
+		}
+	}
+	ServiceDiscovery struct {
+		// File is a Prometheus file_sd file kept up to date with the
+		// resources, disabled when Path is empty
+		File struct {
+			Path string `yaml:"path"`
+			// json or yaml, from the extension of path when empty
+			Format string            `yaml:"format"`
+			Labels map[string]string `yaml:"labels"`
+		}
+	} `yaml:"service_discovery"`
+	// Rules send the jobs they match to a pool, the first match wins
+	Rules []struct {
+		Pool   string            `yaml:"pool"`
+		Job    string            `yaml:"job"`
+		Labels map[string]string `yaml:"labels"`
+		CIDRs  []string          `yaml:"cidrs"`
 	}
 }
 
@@ -40,7 +164,7 @@ func ReadConfig(configPath string) (Config, error) {
 	}
 	err = yaml.Unmarshal(yamlFile, &cfg.FileConfig)
 	if err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+		log.Errorf("Failed to parse config file: %v", err)
 		return Config{}, err
 	}
 
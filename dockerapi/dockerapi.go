@@ -1,12 +1,15 @@
 package dockerapi
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/bass3m/middleman/config"
+	"github.com/bass3m/middleman/resource"
 	"github.com/fsouza/go-dockerclient"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,16 +20,48 @@ const (
 	Stop
 )
 
+// PoolLabel is the container label naming the pool of a resource
+const PoolLabel = "middleman.pool"
+
+// Container labels holding the limits and priority of a resource
+const (
+	MaxJobsLabel   = "middleman.max_jobs"
+	MaxSeriesLabel = "middleman.max_series"
+	PriorityLabel  = "middleman.priority"
+)
+
 type Event struct {
-	action string
-	name   string
-	id     string
-	uri    string
+	Action string
+	Name   string
+	ID     string
+	URI    string
+	Pool   string
+	// MaxJobs and MaxSeries are the limits of the resource, 0 for none
+	MaxJobs   int
+	MaxSeries int
+	Priority  int
+}
+
+// intLabel reads the number of label from labels, 0 when it is missing or
+// invalid
+func intLabel(labels map[string]string, label string) int {
+	v, ok := labels[label]
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Warnf("Invalid %v label %q", label, v)
+		return 0
+	}
+	return n
 }
 
 // XXX add atomic counter for id ?
 
-func dockerEventListener(cfg *config.Config, resourceChan chan<- *Event) {
+// dockerEventListener sends the start and die events of resource containers
+// to resourceChan until ctx is done, then closes it
+func dockerEventListener(ctx context.Context, cfg *config.Config, resourceChan chan<- *Event) {
 	events := make(chan *docker.APIEvents)
 	client := cfg.Client
 	label := cfg.FileConfig.Resources.Docker.Label
@@ -43,10 +78,13 @@ func dockerEventListener(cfg *config.Config, resourceChan chan<- *Event) {
 			log.Fatal(err)
 		}
 		close(events)
+		close(resourceChan)
 	}()
 EventLoop:
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case event := <-events:
 			if event != nil {
 				val, ok := event.Actor.Attributes["middleman.resource"]
@@ -67,18 +105,28 @@ EventLoop:
 						id = event.Actor.ID
 					}
 					if id != "" {
-						resourceChan <- &Event{action: event.Action,
-							name: event.Actor.Attributes["name"],
-							uri:  uri, id: id}
+						ev := &Event{Action: event.Action,
+							Name:      event.Actor.Attributes["name"],
+							Pool:      event.Actor.Attributes[PoolLabel],
+							MaxJobs:   intLabel(event.Actor.Attributes, MaxJobsLabel),
+							MaxSeries: intLabel(event.Actor.Attributes, MaxSeriesLabel),
+							Priority:  intLabel(event.Actor.Attributes, PriorityLabel),
+							URI:       uri, ID: id}
+						select {
+						case resourceChan <- ev:
+						case <-ctx.Done():
+							return
+						}
 					}
 				}
 			}
 		}
 	}
-	return
 }
 
-func SetupDocker(c *config.Config, resourceChan chan<- *Event) error {
+// SetupDocker connects to docker and sends the events of resource containers
+// to resourceChan until ctx is done
+func SetupDocker(ctx context.Context, c *config.Config, resourceChan chan<- *Event) error {
 
 	if c.FileConfig.Resources.Docker.Endpoint == "" {
 		log.Fatal("Docker is enabled but no endpoint for docker API specified")
@@ -91,7 +139,7 @@ func SetupDocker(c *config.Config, resourceChan chan<- *Event) error {
 	}
 
 	c.Client = client
-	go dockerEventListener(c, resourceChan)
+	go dockerEventListener(ctx, c, resourceChan)
 	return nil
 }
 
@@ -114,8 +162,8 @@ func GetDockerResourceByID(client *docker.Client, network string, id string) (st
 	return "", nil
 }
 
-func GetContainerUris(client *docker.Client, label, network string) (map[string]string, error) {
-	uris := map[string]string{}
+func GetContainerUris(client *docker.Client, label, network string) ([]resource.SvrResource, error) {
+	uris := []resource.SvrResource{}
 	cs, err := client.ListContainers(docker.ListContainersOptions{})
 	if err != nil {
 		log.Warnf("No containers found. error: %v", err)
@@ -128,7 +176,7 @@ func GetContainerUris(client *docker.Client, label, network string) (map[string]
 				ip := c.Networks.Networks[network].IPAddress
 				if ip == "" {
 					log.Warnf("IP addr not set yet for container ID %+v", c.ID)
-					return map[string]string{}, fmt.Errorf("IP addr not ready for ID %+v", c.ID)
+					return []resource.SvrResource{}, fmt.Errorf("IP addr not ready for ID %+v", c.ID)
 				}
 				var port int64 = 0
 				for _, p := range c.Ports {
@@ -137,8 +185,15 @@ func GetContainerUris(client *docker.Client, label, network string) (map[string]
 					}
 				}
 				log.Infof("middleman container IP %+v", ip)
+				name := ""
+				if len(c.Names) > 0 {
+					name = strings.TrimPrefix(c.Names[0], "/")
+				}
 				if port != 0 {
-					uris["http://"+ip+":"+strconv.FormatInt(port, 10)] = c.ID
+					uris = append(uris, resource.SvrResource{URI: "http://" + ip + ":" + strconv.FormatInt(port, 10),
+						ID: c.ID, Name: name, Pool: c.Labels[PoolLabel], Source: resource.SourceDocker,
+						MaxJobs: intLabel(c.Labels, MaxJobsLabel), MaxSeries: intLabel(c.Labels, MaxSeriesLabel),
+						Priority: intLabel(c.Labels, PriorityLabel)})
 				}
 			}
 		}
@@ -146,10 +201,10 @@ func GetContainerUris(client *docker.Client, label, network string) (map[string]
 	return uris, nil
 }
 
-func GetResources(cfg config.FileConfig, client *docker.Client) (map[string]string, error) {
+func GetResources(cfg config.FileConfig, client *docker.Client) ([]resource.SvrResource, error) {
 	label := cfg.Resources.Docker.Label
 	network := cfg.Resources.Docker.Network
-	uris := map[string]string{}
+	uris := []resource.SvrResource{}
 	var err error
 
 	log.Infof("Getting docker resources for label %v network %v", label, network)
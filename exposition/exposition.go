@@ -0,0 +1,103 @@
+package exposition
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/bass3m/middleman/grouping"
+	"io/ioutil"
+	"mime"
+	"sort"
+	"strings"
+)
+
+// Types of metric families, as named in the text format
+const (
+	Counter        = "counter"
+	Gauge          = "gauge"
+	Summary        = "summary"
+	Untyped        = "untyped"
+	Histogram      = "histogram"
+	GaugeHistogram = "gaugehistogram"
+)
+
+// label is a label of a pushed sample
+type label struct {
+	name  string
+	value string
+}
+
+// checker holds the checks shared by the text and protobuf formats
+type checker struct {
+	key    grouping.Key
+	series map[string]bool
+}
+
+func newChecker(k grouping.Key) *checker {
+	return &checker{key: k, series: map[string]bool{}}
+}
+
+// sample checks the labels of a sample of metric name against the grouping
+// key and the samples seen so far
+func (c *checker) sample(name string, labels []label) error {
+	sorted := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if v := c.key.Label(l.name); v != "" && v != l.value {
+			return fmt.Errorf("label %s=%q of metric %q conflicts with the grouping key %v", l.name, l.value, name, c.key)
+		}
+		sorted = append(sorted, l.name+"="+l.value)
+	}
+	sort.Strings(sorted)
+	id := name + "{" + strings.Join(sorted, ",") + "}"
+	if c.series[id] {
+		return fmt.Errorf("duplicate sample %v", id)
+	}
+	c.series[id] = true
+	return nil
+}
+
+func labelValue(labels []label, name string) (string, bool) {
+	for _, l := range labels {
+		if l.name == name {
+			return l.value, true
+		}
+	}
+	return "", false
+}
+
+// Validate checks that body, pushed with contentType and contentEncoding for
+// the grouping key k, is something the pushgateway accepts. Text and
+// delimited protobuf are understood, the error describes what is wrong.
+func Validate(contentType string, contentEncoding string, body []byte, k grouping.Key) error {
+	_, err := Series(contentType, contentEncoding, body, k)
+	return err
+}
+
+// Series checks body like Validate and returns its number of series, the
+// samples of the text format or the metrics of protobuf messages
+func Series(contentType string, contentEncoding string, body []byte, k grouping.Key) (int, error) {
+	if strings.EqualFold(contentEncoding, "gzip") {
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return 0, fmt.Errorf("invalid gzip body: %v", err)
+		}
+		if body, err = ioutil.ReadAll(r); err != nil {
+			return 0, fmt.Errorf("invalid gzip body: %v", err)
+		}
+	}
+	if contentType == "" {
+		return validateText(body, k)
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Type %q: %v", contentType, err)
+	}
+	if mediaType == "application/vnd.google.protobuf" {
+		if params["proto"] != "io.prometheus.client.MetricFamily" || params["encoding"] != "delimited" {
+			return 0, fmt.Errorf("unsupported protobuf Content-Type %q", contentType)
+		}
+		return validateProto(body, k)
+	}
+	// the pushgateway reads anything else as text
+	return validateText(body, k)
+}
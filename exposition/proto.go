@@ -0,0 +1,155 @@
+package exposition
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/bass3m/middleman/grouping"
+)
+
+// Protobuf wire types
+const (
+	wireVarint = 0
+	wire64     = 1
+	wireBytes  = 2
+	wire32     = 5
+)
+
+// protoTypes maps the MetricType enum to the text format type names
+var protoTypes = map[uint64]string{0: Counter, 1: Gauge, 2: Summary, 3: Untyped, 4: Histogram, 5: GaugeHistogram}
+
+// Fields of the Metric message holding its value, by family type
+var valueFields = map[int]string{2: Gauge, 3: Counter, 4: Summary, 5: Untyped, 7: Histogram}
+
+// readFields calls f with every field of the protobuf message msg. data is
+// the payload of length delimited fields, v the value of the others.
+func readFields(msg []byte, f func(num int, wire int, data []byte, v uint64) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf field tag")
+		}
+		msg = msg[n:]
+		num, wire := int(tag>>3), int(tag&7)
+		var data []byte
+		var v uint64
+		switch wire {
+		case wireVarint:
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return fmt.Errorf("invalid protobuf varint")
+			}
+			msg = msg[n:]
+		case wire64:
+			if len(msg) < 8 {
+				return fmt.Errorf("truncated protobuf message")
+			}
+			v, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case wire32:
+			if len(msg) < 4 {
+				return fmt.Errorf("truncated protobuf message")
+			}
+			v, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return fmt.Errorf("truncated protobuf message")
+			}
+			data, msg = msg[n:n+int(l)], msg[n+int(l):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wire)
+		}
+		if err := f(num, wire, data, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readLabelPair(msg []byte) (label, error) {
+	var l label
+	err := readFields(msg, func(num int, wire int, data []byte, v uint64) error {
+		switch num {
+		case 1:
+			l.name = string(data)
+		case 2:
+			l.value = string(data)
+		}
+		return nil
+	})
+	return l, err
+}
+
+// validateMetric checks a Metric message of the family name of type typ
+func validateMetric(c *checker, name string, typ string, msg []byte) error {
+	labels := []label{}
+	err := readFields(msg, func(num int, wire int, data []byte, v uint64) error {
+		switch num {
+		case 1:
+			l, err := readLabelPair(data)
+			if err != nil {
+				return err
+			}
+			labels = append(labels, l)
+		case 6:
+			return fmt.Errorf("metric %q has a timestamp, pushed metrics must not", name)
+		default:
+			t, ok := valueFields[num]
+			if ok && t != typ && !(t == Histogram && typ == GaugeHistogram) {
+				return fmt.Errorf("metric %q of type %s has a %s value", name, typ, t)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.sample(name, labels)
+}
+
+// validateProto checks a body of length delimited MetricFamily messages and
+// counts its series
+func validateProto(body []byte, k grouping.Key) (int, error) {
+	c := newChecker(k)
+	families := map[string]bool{}
+	for len(body) > 0 {
+		l, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < l {
+			return 0, fmt.Errorf("truncated protobuf message")
+		}
+		msg := body[n : n+int(l)]
+		body = body[n+int(l):]
+
+		name, typ := "", Counter
+		metrics := [][]byte{}
+		err := readFields(msg, func(num int, wire int, data []byte, v uint64) error {
+			switch num {
+			case 1:
+				name = string(data)
+			case 3:
+				t, ok := protoTypes[v]
+				if !ok {
+					return fmt.Errorf("unknown metric type %d", v)
+				}
+				typ = t
+			case 4:
+				metrics = append(metrics, data)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if name == "" {
+			return 0, fmt.Errorf("metric family without a name")
+		}
+		if families[name] {
+			return 0, fmt.Errorf("metric family %q appears twice", name)
+		}
+		families[name] = true
+		for _, m := range metrics {
+			if err := validateMetric(c, name, typ, m); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(c.series), nil
+}
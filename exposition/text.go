@@ -0,0 +1,209 @@
+package exposition
+
+import (
+	"fmt"
+	"github.com/bass3m/middleman/grouping"
+	"strconv"
+	"strings"
+)
+
+func isNameChar(c byte, first bool, colon bool) bool {
+	return c == '_' || (colon && c == ':') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(!first && c >= '0' && c <= '9')
+}
+
+// readName reads a metric or label name at the start of s
+func readName(s string, colon bool) (string, string) {
+	i := 0
+	for i < len(s) && isNameChar(s[i], i == 0, colon) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// readLabels reads the label set at the start of s, which follows the '{'
+func readLabels(s string) ([]label, string, error) {
+	labels := []label{}
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+		var l label
+		if l.name, s = readName(s, false); l.name == "" {
+			return nil, "", fmt.Errorf("invalid label name")
+		}
+		s = strings.TrimLeft(s, " \t")
+		if !strings.HasPrefix(s, "=") {
+			return nil, "", fmt.Errorf("expected '=' after label name %v", l.name)
+		}
+		s = strings.TrimLeft(s[1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return nil, "", fmt.Errorf("expected quoted value for label %v", l.name)
+		}
+		var v strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				v.WriteByte(s[i])
+				continue
+			}
+			if i++; i == len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				v.WriteByte('\n')
+			case '\\', '"':
+				v.WriteByte(s[i])
+			default:
+				return nil, "", fmt.Errorf("invalid escape in value of label %v", l.name)
+			}
+		}
+		if i >= len(s) {
+			return nil, "", fmt.Errorf("unterminated value of label %v", l.name)
+		}
+		l.value = v.String()
+		if _, dup := labelValue(labels, l.name); dup {
+			return nil, "", fmt.Errorf("duplicate label %v", l.name)
+		}
+		labels = append(labels, l)
+		s = strings.TrimLeft(s[i+1:], " \t")
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, "", fmt.Errorf("expected ',' or '}' after label %v", l.name)
+		}
+	}
+}
+
+// FamilyOf returns the family the sample name belongs to when cur, of type
+// typ, is the family being read
+func FamilyOf(name string, cur string, typ string) string {
+	if cur == "" {
+		return name
+	}
+	suffixes := []string{}
+	switch typ {
+	case Histogram, GaugeHistogram:
+		suffixes = []string{"_bucket", "_sum", "_count"}
+	case Summary:
+		suffixes = []string{"_sum", "_count"}
+	}
+	for _, s := range suffixes {
+		if name == cur+s {
+			return cur
+		}
+	}
+	return name
+}
+
+func validType(t string) bool {
+	switch t {
+	case Counter, Gauge, Summary, Untyped, Histogram, GaugeHistogram:
+		return true
+	}
+	return false
+}
+
+// validateText checks a text format body and counts its series
+func validateText(body []byte, k grouping.Key) (int, error) {
+	c := newChecker(k)
+	types := map[string]string{}
+	helps := map[string]bool{}
+	seen := map[string]bool{}
+	cur := ""
+	for n, line := range strings.Split(string(body), "\n") {
+		lineErr := func(format string, args ...interface{}) error {
+			return fmt.Errorf("line %d: %s", n+1, fmt.Sprintf(format, args...))
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) < 3 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+				continue
+			}
+			name := fields[2]
+			if fields[1] == "HELP" {
+				if helps[name] {
+					return 0, lineErr("second HELP line for metric %q", name)
+				}
+				helps[name] = true
+			} else {
+				if _, ok := types[name]; ok {
+					return 0, lineErr("second TYPE line for metric %q", name)
+				}
+				if seen[name] {
+					return 0, lineErr("TYPE line for metric %q after its samples", name)
+				}
+				if len(fields) != 4 || !validType(fields[3]) {
+					return 0, lineErr("invalid TYPE line for metric %q", name)
+				}
+				types[name] = fields[3]
+			}
+			if cur != name && seen[name] {
+				return 0, lineErr("samples of metric %q are not grouped together", name)
+			}
+			cur = name
+			continue
+		}
+
+		name, rest := readName(line, true)
+		if name == "" {
+			return 0, lineErr("invalid metric name")
+		}
+		labels := []label{}
+		rest = strings.TrimLeft(rest, " \t")
+		if strings.HasPrefix(rest, "{") {
+			var err error
+			if labels, rest, err = readLabels(rest[1:]); err != nil {
+				return 0, lineErr("metric %q: %v", name, err)
+			}
+		}
+		fields := strings.Fields(rest)
+		switch {
+		case len(fields) == 0:
+			return 0, lineErr("metric %q has no value", name)
+		case len(fields) == 2:
+			return 0, lineErr("metric %q has a timestamp, pushed metrics must not", name)
+		case len(fields) > 2:
+			return 0, lineErr("metric %q has trailing data", name)
+		}
+		if _, err := strconv.ParseFloat(fields[0], 64); err != nil {
+			return 0, lineErr("metric %q has invalid value %q", name, fields[0])
+		}
+
+		fam := FamilyOf(name, cur, types[cur])
+		if fam != cur && seen[fam] {
+			return 0, lineErr("samples of metric %q are not grouped together", fam)
+		}
+		seen[fam] = true
+		cur = fam
+		switch types[fam] {
+		case Histogram, GaugeHistogram:
+			if name == fam {
+				return 0, lineErr("metric %q of type %s has a plain sample", fam, types[fam])
+			}
+			if name == fam+"_bucket" {
+				le, ok := labelValue(labels, "le")
+				if _, err := strconv.ParseFloat(le, 64); !ok || err != nil {
+					return 0, lineErr("bucket of histogram %q has no valid le label", fam)
+				}
+			}
+		case Summary:
+			if name == fam {
+				q, ok := labelValue(labels, "quantile")
+				if _, err := strconv.ParseFloat(q, 64); !ok || err != nil {
+					return 0, lineErr("sample of summary %q has no valid quantile label", fam)
+				}
+			}
+		}
+		if err := c.sample(name, labels); err != nil {
+			return 0, lineErr("%v", err)
+		}
+	}
+	return len(c.series), nil
+}
@@ -0,0 +1,160 @@
+package grouping
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Base64Suffix marks a label name, or the job, whose value is base64url encoded
+const Base64Suffix = "@base64"
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Key is the grouping key of a push, the job name and the labels of the push
+// URL path. Labels are sorted by name and labels with an empty value are
+// dropped, like the pushgateway does, so equal groups have equal keys no
+// matter how their path was written.
+type Key struct {
+	Job    string
+	Labels []Label
+}
+
+func decodeBase64(s string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	return string(b), err
+}
+
+// Parse builds the grouping key from the :job and *labels route params.
+// jobBase64 is set when the job was pushed with the job@base64 form.
+func Parse(job string, jobBase64 bool, labels string) (Key, error) {
+	if jobBase64 {
+		j, err := decodeBase64(job)
+		if err != nil {
+			return Key{}, fmt.Errorf("Invalid base64 encoding for job %q: %v", job, err)
+		}
+		job = j
+	}
+	if job == "" {
+		return Key{}, fmt.Errorf("Job name is required")
+	}
+	k := Key{Job: job, Labels: []Label{}}
+
+	labels = strings.Trim(labels, "/")
+	if labels == "" {
+		return k, nil
+	}
+	components := strings.Split(labels, "/")
+	if len(components)%2 != 0 {
+		return Key{}, fmt.Errorf("Odd number of components in label string %q", labels)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < len(components); i += 2 {
+		name, value := components[i], components[i+1]
+		trimmed := strings.TrimSuffix(name, Base64Suffix)
+		if !labelNameRE.MatchString(trimmed) || strings.HasPrefix(trimmed, "__") {
+			return Key{}, fmt.Errorf("Improper label name %q", trimmed)
+		}
+		if trimmed != name {
+			v, err := decodeBase64(value)
+			if err != nil {
+				return Key{}, fmt.Errorf("Invalid base64 encoding for label %s=%q: %v", trimmed, value, err)
+			}
+			value = v
+		}
+		if seen[trimmed] {
+			return Key{}, fmt.Errorf("Duplicate label name %q", trimmed)
+		}
+		seen[trimmed] = true
+		// the job param always wins, an empty value is the same as no label
+		if trimmed == "job" || value == "" {
+			continue
+		}
+		k.Labels = append(k.Labels, Label{Name: trimmed, Value: value})
+	}
+	sort.Slice(k.Labels, func(i, j int) bool { return k.Labels[i].Name < k.Labels[j].Name })
+	return k, nil
+}
+
+// ParsePath builds the grouping key from a push path of the form
+// /job/<job>{/<label>/<value>}, with or without the /metrics prefix
+func ParsePath(path string) (Key, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "/"), "metrics/")
+	jobBase64 := false
+	switch {
+	case strings.HasPrefix(path, "job/"):
+		path = strings.TrimPrefix(path, "job/")
+	case strings.HasPrefix(path, "job"+Base64Suffix+"/"):
+		path = strings.TrimPrefix(path, "job"+Base64Suffix+"/")
+		jobBase64 = true
+	default:
+		return Key{}, fmt.Errorf("Path %q is not a push path", path)
+	}
+	job, labels := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		job, labels = path[:i], path[i:]
+	}
+	return Parse(job, jobBase64, labels)
+}
+
+// Label returns the value of the named label, the job included
+func (k Key) Label(name string) string {
+	if name == "job" {
+		return k.Job
+	}
+	for _, l := range k.Labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// Matches reports whether k has the job of sel and every one of its labels,
+// so a selector with only a job matches every group of that job
+func (k Key) Matches(sel Key) bool {
+	if k.Job != sel.Job {
+		return false
+	}
+	for _, l := range sel.Labels {
+		if k.Label(l.Name) != l.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// String is the canonical form of the key, suitable as a map key
+func (k Key) String() string {
+	pairs := make([]string, 0, len(k.Labels)+1)
+	pairs = append(pairs, fmt.Sprintf("job=%q", k.Job))
+	for _, l := range k.Labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l.Name, l.Value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func encodeComponent(name, value string) string {
+	if strings.Contains(value, "/") {
+		return name + Base64Suffix + "/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return name + "/" + url.PathEscape(value)
+}
+
+// Path is the canonical, escaped push path of the key, without the /metrics
+// prefix
+func (k Key) Path() string {
+	components := []string{encodeComponent("job", k.Job)}
+	for _, l := range k.Labels {
+		components = append(components, encodeComponent(l.Name, l.Value))
+	}
+	return "/" + strings.Join(components, "/")
+}
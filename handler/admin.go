@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bass3m/middleman/resource"
+	"github.com/bass3m/middleman/tenant"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+)
+
+// admin reports whether r has admin rights
+func (o Options) admin(r *http.Request) bool {
+	if o.AdminToken == "" {
+		return o.Tenants.Admin(r)
+	}
+	return tenant.BearerToken(r) == o.AdminToken || (o.Tenants != nil && o.Tenants.Admin(r))
+}
+
+// seesAll reports whether r sees the jobs and resources of every tenant,
+// everyone does without tenants
+func (o Options) seesAll(r *http.Request) bool {
+	return o.Tenants == nil || o.admin(r)
+}
+
+// requireAdmin replies 403 to requests without admin rights
+func requireAdmin(w http.ResponseWriter, r *http.Request, opts Options) bool {
+	if !opts.admin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// AddResource adds the resource described by the JSON body
+func AddResource(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !requireAdmin(w, r, opts) {
+			return
+		}
+		var sr resource.SvrResource
+		if err := json.NewDecoder(r.Body).Decode(&sr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if sr.URI == "" {
+			http.Error(w, "Missing resource uri", http.StatusBadRequest)
+			return
+		}
+		sr.Source = resource.SourceAPI
+		if err := m.AddResource(sr); err != nil {
+			log.Errorf("Failed to add resource %v: %v", sr.URI, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Infof("Added resource %v through the admin API", sr.URI)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// selectedResource returns the URL of the resource named by the id or url
+// query parameter of r. It replies to the client itself when there is none.
+func selectedResource(w http.ResponseWriter, r *http.Request, m *resource.Manager) (string, bool) {
+	q := r.URL.Query()
+	id, u := q.Get("id"), q.Get("url")
+	if id == "" && u == "" {
+		http.Error(w, "Missing resource id or url", http.StatusBadRequest)
+		return "", false
+	}
+	for _, res := range m.ResourceList() {
+		if (id != "" && res.ID == id) || (id == "" && res.URL.String() == u) {
+			return res.URL.String(), true
+		}
+	}
+	http.Error(w, "No such resource", http.StatusNotFound)
+	return "", false
+}
+
+// RemoveResource removes the resource named by the id or url query parameter
+func RemoveResource(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !requireAdmin(w, r, opts) {
+			return
+		}
+		u, ok := selectedResource(w, r, m)
+		if !ok {
+			return
+		}
+		if err := m.RemoveResourceURL(u); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Infof("Removed resource %v through the admin API", u)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DrainResource drains, or undrains, the resource named by the id or url
+// query parameter. Its jobs move to the other resources of its pool.
+func DrainResource(m *resource.Manager, opts Options, draining bool) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !requireAdmin(w, r, opts) {
+			return
+		}
+		u, ok := selectedResource(w, r, m)
+		if !ok {
+			return
+		}
+		if err := m.Drain(u, draining); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Infof("Set draining of resource %v to %v through the admin API", u, draining)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Rebalance evens out the jobs of the resources of the pool query parameter,
+// of every pool without one, and returns the plan. With dry_run=true only the
+// plan is returned. Moving jobs needs replay so their metrics move with them.
+func Rebalance(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !requireAdmin(w, r, opts) {
+			return
+		}
+		pool := r.URL.Query().Get("pool")
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		var plan resource.Plan
+		if dryRun {
+			plan = m.PlanRebalance(pool)
+		} else if opts.Payloads == nil {
+			http.Error(w, "Rebalancing needs replay enabled", http.StatusConflict)
+			return
+		} else {
+			plan = m.Rebalance(pool)
+			log.Infof("Rebalanced %d jobs through the admin API", len(plan.Moves))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(plan); err != nil {
+			log.Error("Error encoding plan:", err)
+		}
+	}
+}
+
+// WhatIf reports what the change of resources in the JSON body would do to
+// the jobs, without changing anything
+func WhatIf(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !requireAdmin(w, r, opts) {
+			return
+		}
+		var change resource.Change
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := m.WhatIf(change)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Error("Error encoding what-if:", err)
+		}
+	}
+}
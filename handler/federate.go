@@ -0,0 +1,311 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bass3m/middleman/exposition"
+	"github.com/bass3m/middleman/resource"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResourceLabel labels federated data with the resource it came from
+const ResourceLabel = "middleman_resource"
+
+// federateTimeout bounds how long we wait for a resource when federating
+const federateTimeout = 10 * time.Second
+
+// fetchResult is the answer of one resource to a federated request
+type fetchResult struct {
+	resource resource.Resource
+	body     []byte
+	err      error
+}
+
+// fetchAll GETs path from every resource concurrently, results are in the
+// order of resources
+func fetchAll(ctx context.Context, resources []resource.Resource, path string) []fetchResult {
+	ctx, cancel := context.WithTimeout(ctx, federateTimeout)
+	defer cancel()
+	results := make([]fetchResult, len(resources))
+	var wg sync.WaitGroup
+	for i, res := range resources {
+		wg.Add(1)
+		go func(i int, res resource.Resource) {
+			defer wg.Done()
+			results[i].resource = res
+			req, err := http.NewRequest("GET", res.URL.String()+path, nil)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			resp, err := res.Client.Do(req.WithContext(ctx))
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				results[i].err = fmt.Errorf("HTTP status %d", resp.StatusCode)
+				return
+			}
+			results[i].body, results[i].err = ioutil.ReadAll(resp.Body)
+		}(i, res)
+	}
+	wg.Wait()
+	return results
+}
+
+// scopedResources returns the resources r may read from. The admin reads
+// from every resource, a tenant only from its own pool.
+func scopedResources(w http.ResponseWriter, r *http.Request, ps httprouter.Params, m *resource.Manager,
+	opts Options) ([]resource.Resource, bool) {
+	all := m.ResourceList()
+	if opts.seesAll(r) {
+		return all, true
+	}
+	t, ok := identifyTenant(w, r, ps, opts)
+	if !ok {
+		return nil, false
+	}
+	if t.Pool == "" {
+		http.Error(w, "Tenant has no pool of its own", http.StatusForbidden)
+		return nil, false
+	}
+	rs := []resource.Resource{}
+	for _, res := range all {
+		if res.Pool == t.Pool {
+			rs = append(rs, res)
+		}
+	}
+	return rs, true
+}
+
+// apiResponse is the envelope of the pushgateway API
+type apiResponse struct {
+	Status   string      `json:"status"`
+	Data     interface{} `json:"data"`
+	Warnings []string    `json:"warnings,omitempty"`
+}
+
+func writeAPIResponse(w http.ResponseWriter, resp apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error("Error encoding API response:", err)
+	}
+}
+
+// decodeData decodes the data of a pushgateway API answer into data
+func decodeData(body []byte, data interface{}) error {
+	var resp struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return err
+	}
+	if resp.Status != "success" {
+		return fmt.Errorf("API status %q", resp.Status)
+	}
+	return json.Unmarshal(resp.Data, data)
+}
+
+// FederatedMetrics merges /api/v1/metrics of every resource, labelling every
+// group with the resource it is on
+func FederatedMetrics(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		resources, ok := scopedResources(w, r, ps, m, opts)
+		if !ok {
+			return
+		}
+		resp := apiResponse{Status: "success"}
+		groups := []map[string]json.RawMessage{}
+		for _, res := range fetchAll(r.Context(), resources, "/api/v1/metrics") {
+			var data []map[string]json.RawMessage
+			err := res.err
+			if err == nil {
+				err = decodeData(res.body, &data)
+			}
+			if err != nil {
+				log.Warnf("Error federating metrics of %v: %v", res.resource.URL, err)
+				resp.Warnings = append(resp.Warnings, fmt.Sprintf("%s: %v", res.resource.Label(), err))
+				continue
+			}
+			for _, g := range data {
+				labels := map[string]string{}
+				if raw, ok := g["labels"]; ok {
+					if err := json.Unmarshal(raw, &labels); err != nil {
+						resp.Warnings = append(resp.Warnings, fmt.Sprintf("%s: %v", res.resource.Label(), err))
+						continue
+					}
+				}
+				labels[ResourceLabel] = res.resource.Label()
+				g["labels"], _ = json.Marshal(labels)
+				groups = append(groups, g)
+			}
+		}
+		resp.Data = groups
+		writeAPIResponse(w, resp)
+	}
+}
+
+// FederatedStatus returns /api/v1/status of every resource, keyed by resource
+func FederatedStatus(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		resources, ok := scopedResources(w, r, ps, m, opts)
+		if !ok {
+			return
+		}
+		resp := apiResponse{Status: "success"}
+		statuses := map[string]json.RawMessage{}
+		for _, res := range fetchAll(r.Context(), resources, "/api/v1/status") {
+			var data json.RawMessage
+			err := res.err
+			if err == nil {
+				err = decodeData(res.body, &data)
+			}
+			if err != nil {
+				log.Warnf("Error federating status of %v: %v", res.resource.URL, err)
+				resp.Warnings = append(resp.Warnings, fmt.Sprintf("%s: %v", res.resource.Label(), err))
+				continue
+			}
+			statuses[res.resource.Label()] = data
+		}
+		resp.Data = statuses
+		writeAPIResponse(w, resp)
+	}
+}
+
+// scrapedFamily is a metric family merged from the scrapes of resources
+type scrapedFamily struct {
+	help    string
+	typ     string
+	samples []string
+}
+
+// withResourceLabel adds the resource label to a sample line
+func withResourceLabel(line string, name string) string {
+	label := ResourceLabel + `="` + labelEscaper.Replace(name) + `"`
+	i := strings.IndexAny(line, "{ \t")
+	if i < 0 {
+		return line
+	}
+	if line[i] != '{' {
+		return line[:i] + "{" + label + "}" + line[i:]
+	}
+	if strings.HasPrefix(strings.TrimLeft(line[i+1:], " "), "}") {
+		return line[:i+1] + label + line[i+1:]
+	}
+	return line[:i+1] + label + "," + line[i+1:]
+}
+
+// mergeScrape adds the text format exposition body scraped from resource
+// name to families, keeping the first HELP and TYPE of every family. Samples
+// of a family whose TYPE conflicts with an earlier resource are dropped.
+func mergeScrape(families map[string]*scrapedFamily, order *[]string, name string, body []byte) {
+	cur := ""
+	types := map[string]string{}
+	conflicting := map[string]bool{}
+	family := func(n string) *scrapedFamily {
+		f, ok := families[n]
+		if !ok {
+			f = &scrapedFamily{}
+			families[n] = f
+			*order = append(*order, n)
+		}
+		return f
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+				continue
+			}
+			cur = fields[2]
+			text := ""
+			if len(fields) == 4 {
+				text = fields[3]
+			}
+			f := family(cur)
+			if fields[1] == "HELP" && f.help == "" {
+				f.help = text
+			} else if fields[1] == "TYPE" {
+				types[cur] = text
+				if f.typ == "" {
+					f.typ = text
+				} else if f.typ != text && !conflicting[cur] {
+					log.Warnf("Resource %v has type %v for %v, not %v, dropping its samples", name, text, cur, f.typ)
+					conflicting[cur] = true
+				}
+			}
+			continue
+		}
+		n := line
+		if i := strings.IndexAny(line, "{ \t"); i >= 0 {
+			n = line[:i]
+		}
+		fn := exposition.FamilyOf(n, cur, types[cur])
+		if conflicting[fn] {
+			continue
+		}
+		f := family(fn)
+		f.samples = append(f.samples, withResourceLabel(line, name))
+	}
+}
+
+// Scrape scrapes /metrics of every healthy resource in parallel and serves
+// them merged in one exposition, every sample labelled with its resource.
+// middleman_scrape_up tells which resources could be scraped.
+func Scrape(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		all, ok := scopedResources(w, r, ps, m, opts)
+		if !ok {
+			return
+		}
+		resources := []resource.Resource{}
+		for _, res := range all {
+			if !res.Unhealthy {
+				resources = append(resources, res)
+			}
+		}
+		families := map[string]*scrapedFamily{}
+		order := []string{}
+		up := &metricFamily{name: "middleman_scrape_up", typ: "gauge",
+			help: "Whether the resource could be scraped."}
+		for _, res := range fetchAll(r.Context(), resources, "/metrics") {
+			labels := map[string]string{"resource": res.resource.Label()}
+			if res.err != nil {
+				log.Warnf("Error scraping %v: %v", res.resource.URL, res.err)
+				up.add(labels, 0)
+				continue
+			}
+			mergeScrape(families, &order, res.resource.Label(), res.body)
+			up.add(labels, 1)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, n := range order {
+			f := families[n]
+			if f.help != "" {
+				fmt.Fprintf(w, "# HELP %s %s\n", n, f.help)
+			}
+			if f.typ != "" {
+				fmt.Fprintf(w, "# TYPE %s %s\n", n, f.typ)
+			}
+			for _, s := range f.samples {
+				fmt.Fprintln(w, s)
+			}
+		}
+		up.write(w)
+	}
+}
@@ -1,84 +1,426 @@
 package handler
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/bass3m/middleman/clientid"
+	"github.com/bass3m/middleman/exposition"
+	"github.com/bass3m/middleman/grouping"
+	"github.com/bass3m/middleman/payload"
 	"github.com/bass3m/middleman/resource"
+	"github.com/bass3m/middleman/spool"
+	"github.com/bass3m/middleman/tenant"
 	"github.com/julienschmidt/httprouter"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Options holds what the handlers need besides the resource manager
+type Options struct {
+	// Clients works out the client host of pushes, nil trusts no proxy
+	Clients *clientid.Resolver
+	// Tenants identifies the tenant of requests, nil disables tenants
+	Tenants *tenant.Registry
+	// DeletePrefix makes a delete remove every group it matches, so deleting
+	// a job without labels removes all its groups
+	DeletePrefix bool
+	// BroadcastUnknownDeletes sends deletes of unknown groups to every
+	// resource of their pool
+	BroadcastUnknownDeletes bool
+	// ValidatePushes rejects pushes the pushgateway would refuse before
+	// forwarding them
+	ValidatePushes bool
+	// Payloads caches the last push of every job to replay it when the job
+	// moves, nil disables replay
+	Payloads *payload.Cache
+	// Spool keeps the pushes resources fail to take and delivers them
+	// later, nil drops them
+	Spool *spool.Spooler
+	// Federate serves the merged metrics of every healthy resource on
+	// /federate
+	Federate bool
+	// Readiness is served on /-/ready, nil is always ready
+	Readiness *Readiness
+	// AdminToken is the bearer token of admin requests, the tenants' admin
+	// token also works. Without either the admin API is open.
+	AdminToken string
+}
+
+// retryAfter is the Retry-After, in seconds, of new jobs turned away because
+// no resource of their pool can take them
+const retryAfter = 60
+
+// countingReader counts the bytes read from the wrapped reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 func Index(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	fmt.Fprint(w, "Index page\n")
 }
 
-func Status(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	fmt.Fprint(w, "Status page\n")
+// identifyTenant returns the tenant of r, nil when tenants are disabled.
+// It replies to the client itself when r has no valid tenant.
+func identifyTenant(w http.ResponseWriter, r *http.Request, ps httprouter.Params, opts Options) (*tenant.Tenant, bool) {
+	t, err := opts.Tenants.Identify(r, ps)
+	if err != nil {
+		log.Warnf("Error %v identifying tenant for url: %v", err, r.URL)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	return t, true
+}
+
+func tenantName(t *tenant.Tenant) string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// scopedStats returns the resources and jobs r may see. The admin sees
+// everything, a tenant its own jobs and the resources of its pool or jobs.
+func scopedStats(w http.ResponseWriter, r *http.Request, ps httprouter.Params, m *resource.Manager,
+	opts Options) ([]resource.ResourceStats, []resource.JobStats, bool) {
+	if opts.seesAll(r) {
+		return m.ResourceStats(), m.JobStats(), true
+	}
+	t, ok := identifyTenant(w, r, ps, opts)
+	if !ok {
+		return nil, nil, false
+	}
+	jobs := []resource.JobStats{}
+	used := map[string]bool{}
+	for _, js := range m.JobStats() {
+		if js.Tenant == t.Name {
+			jobs = append(jobs, js)
+			used[js.Resource] = true
+		}
+	}
+	resources := []resource.ResourceStats{}
+	for _, rs := range m.ResourceStats() {
+		if used[rs.URL] || (t.Pool != "" && rs.Pool == t.Pool) {
+			resources = append(resources, rs)
+		}
+	}
+	return resources, jobs, true
+}
+
+// upstreamPath is the path of the push or delete r on a resource, without
+// our route prefix
+func upstreamPath(r *http.Request) string {
+	path := r.URL.EscapedPath()
+	if i := strings.Index(path, "/metrics/job"); i > 0 {
+		path = path[i:]
+	}
+	return path
+}
+
+// upstreamURL is the URL of the push or delete r on resource
+func upstreamURL(res resource.Resource, r *http.Request) string {
+	return res.URL.String() + upstreamPath(r)
+}
+
+// spoolPush spools rec for res and tells the client the push is accepted.
+// It returns false when the spool refused it.
+func spoolPush(w http.ResponseWriter, opts Options, res resource.Resource, rec spool.Record) bool {
+	if err := opts.Spool.Enqueue(res.URL.String(), res.Client, rec); err != nil {
+		log.Errorf("Failed to spool push %v to %v: %v", rec.Path, res.URL, err)
+		http.Error(w, "Resource unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+	log.Debugf("Spooled push %v to %v", rec.Path, res.URL)
+	w.WriteHeader(http.StatusAccepted)
+	return true
+}
+
+func Status(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		resources, jobs, ok := scopedStats(w, r, ps, m, opts)
+		if !ok {
+			return
+		}
+		status := struct {
+			Resources []resource.ResourceStats `json:"resources"`
+			Jobs      []resource.JobStats      `json:"jobs"`
+		}{Resources: resources, Jobs: jobs}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Error("Error encoding status:", err)
+		}
+	}
+}
+
+// groupingKey parses the grouping key of a push or delete from its route params
+func groupingKey(ps httprouter.Params) (grouping.Key, error) {
+	if job := ps.ByName("job_base64"); job != "" {
+		return grouping.Parse(job, true, ps.ByName("labels"))
+	}
+	return grouping.Parse(ps.ByName("job"), false, ps.ByName("labels"))
 }
 
-func Push(m *resource.Manager) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func Push(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		resource, err := m.FindResource(r.RemoteAddr, r.URL)
+		key, err := groupingKey(ps)
+		if err != nil {
+			log.Errorf("Error %v parsing grouping key for url: %v\n", err, r.URL)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t, ok := identifyTenant(w, r, ps, opts)
+		if !ok {
+			return
+		}
+		if t != nil {
+			if ok, wait := t.Allow(); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Tenant push rate exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+		var data []byte
+		var body io.Reader = r.Body
+		countSeries := m.LimitsSeries()
+		if opts.ValidatePushes || opts.Payloads != nil || opts.Spool != nil || countSeries {
+			if data, err = ioutil.ReadAll(r.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = bytes.NewReader(data)
+		}
+		series := 0
+		if opts.ValidatePushes || countSeries {
+			series, err = exposition.Series(r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding"), data, key)
+			if err != nil && opts.ValidatePushes {
+				log.Warnf("Rejected invalid push for url %v: %v", r.URL, err)
+				http.Error(w, "Invalid push: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		tn := tenantName(t)
+		client := opts.Clients.Client(r)
+		res, err := m.FindResource(tn, client, key)
+		if err == resource.ErrNoHealthyResource && opts.Spool != nil {
+			// new jobs wait in the spool for a resource of their pool to be back
+			res, err = m.FindSpoolResource(tn, client, key)
+		}
 		if err != nil {
-			log.Errorf("Error %v getting resource for url: %v\n", err, resource.URL)
+			log.Errorf("Error %v getting resource for url: %v\n", err, r.URL)
+			switch err {
+			case resource.ErrTenantQuota:
+				http.Error(w, err.Error(), http.StatusForbidden)
+			default:
+				// the pool is full, down or gone, the client should push again
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			}
+			return
+		}
+		if countSeries {
+			m.RecordSeries(tn, client, key, series)
+		}
+		header := payload.Header(r.Header)
+		keep := func() {
+			if opts.Payloads != nil {
+				opts.Payloads.Put(payloadKey(m.JobKey(tn, client, key), key),
+					payload.Entry{Method: r.Method, Header: header, Body: data})
+			}
+		}
+		rec := spool.Record{Method: r.Method, Path: upstreamPath(r), Header: header, Body: data, Time: time.Now()}
+		if opts.Spool != nil && (res.Unhealthy || opts.Spool.Pending(res.URL.String())) {
+			// queue behind the pushes already spooled to keep them in order,
+			// or until the resource is back
+			m.RecordPush(tn, client, key, int64(len(data)), 0, 0)
+			if spoolPush(w, opts, res, rec) {
+				keep()
+			}
 			return
 		}
-		req, err := http.NewRequest(r.Method, resource.URL.String()+r.URL.String(), r.Body)
+		counted := &countingReader{r: body}
+		req, err := http.NewRequest(r.Method, upstreamURL(res, r), counted)
 		if err != nil {
 			log.Error("Error creating request:", err)
 			return
 		}
+		for h, v := range header {
+			req.Header[h] = v
+		}
 
-		client := resource.Client
-		resp, err := client.Do(req)
+		start := time.Now()
+		resp, err := res.Client.Do(req)
 		if err != nil {
 			log.Error("Error sending to resource:", err)
+			m.RecordPush(tn, client, key, counted.n, 0, time.Since(start))
+			if opts.Spool != nil && spoolPush(w, opts, res, rec) {
+				keep()
+			}
 			return
 		}
 		defer resp.Body.Close()
+		m.RecordPush(tn, client, key, counted.n, resp.StatusCode, time.Since(start))
+		if resp.StatusCode >= 500 && opts.Spool != nil {
+			log.Errorf("HTTP status %d from %v, spooling push", resp.StatusCode, res.URL)
+			if spoolPush(w, opts, res, rec) {
+				keep()
+			}
+			return
+		}
 		if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-			log.Error("HTTP status %d", resp.StatusCode)
+			log.Errorf("HTTP status %d", resp.StatusCode)
+			return
 		}
+		keep()
 
 	}
 }
 
-func Delete(m *resource.Manager) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// sendDeletes sends the deletions concurrently and returns how many failed
+func sendDeletes(deletions []resource.Deletion) int {
+	var wg sync.WaitGroup
+	var failed int32
+	for _, d := range deletions {
+		wg.Add(1)
+		go func(d resource.Deletion) {
+			defer wg.Done()
+			u := d.Resource.URL.String() + "/metrics" + d.Key.Path()
+			req, err := http.NewRequest("DELETE", u, nil)
+			if err != nil {
+				log.Error("Error creating request:", err)
+				atomic.AddInt32(&failed, 1)
+				return
+			}
+			resp, err := d.Resource.Client.Do(req)
+			if err != nil {
+				log.Error("Error sending to resource:", err)
+				atomic.AddInt32(&failed, 1)
+				return
+			}
+			defer resp.Body.Close()
+			if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+				log.Errorf("HTTP status %d deleting %v", resp.StatusCode, u)
+				atomic.AddInt32(&failed, 1)
+			}
+		}(d)
+	}
+	wg.Wait()
+	return int(failed)
+}
+
+// Delete forgets the deleted group and deletes it from its resource. With
+// DeletePrefix every group matching the deleted one is deleted, and with
+// BroadcastUnknownDeletes groups we don't know of are deleted from every
+// resource they could be on.
+func Delete(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		log.Infof("DELETE job")
-		resource, err := m.DeleteJob(r.RemoteAddr, r.URL)
+		key, err := groupingKey(ps)
 		if err != nil {
-			log.Errorf("Error %v deleting resource for url: %v\n", err, resource.URL)
+			log.Errorf("Error %v parsing grouping key for url: %v\n", err, r.URL)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		req, err := http.NewRequest(r.Method, resource.URL.String()+r.URL.String(), r.Body)
-		if err != nil {
-			log.Error("Error creating request:", err)
+		t, ok := identifyTenant(w, r, ps, opts)
+		if !ok {
 			return
 		}
-
-		client := resource.Client
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Error("Error sending to resource:", err)
-			return
+		tn := tenantName(t)
+		client := opts.Clients.Client(r)
+		deletions := []resource.Deletion{}
+		if opts.DeletePrefix {
+			deletions = m.DeleteMatching(tn, key)
+		} else if res, err := m.DeleteJob(tn, client, key); err == nil {
+			deletions = append(deletions, resource.Deletion{Resource: res, Key: key,
+				Jobs: []resource.JobKey{m.JobKey(tn, client, key)}})
+		} else {
+			log.Errorf("Error %v deleting resource for url: %v\n", err, r.URL)
 		}
-		defer resp.Body.Close()
-		if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-			log.Error("HTTP status %d", resp.StatusCode)
+		if opts.Payloads != nil {
+			for _, d := range deletions {
+				for _, j := range d.Jobs {
+					opts.Payloads.Delete(payloadKey(j, d.Key))
+				}
+			}
+		}
+		if len(deletions) == 0 {
+			if !opts.BroadcastUnknownDeletes {
+				return
+			}
+			log.Infof("Broadcasting delete of unknown group %v", key)
+			for _, res := range m.PoolResources(tn, client, key) {
+				deletions = append(deletions, resource.Deletion{Resource: res, Key: key})
+			}
+		}
+		if failed := sendDeletes(deletions); failed > 0 {
+			log.Errorf("%d of %d deletes failed for url: %v", failed, len(deletions), r.URL)
 		}
 	}
 }
 
-func SetupRoutes(router *httprouter.Router, m *resource.Manager, routePrefix string) {
+// pushRoutes registers the push and delete routes of the pushgateway API
+// under base
+func pushRoutes(router *httprouter.Router, base string, m *resource.Manager, opts Options) {
+	pushAPIPath := base + "/metrics"
+	router.PUT(pushAPIPath+"/job/:job/*labels", Push(m, opts))
+	router.POST(pushAPIPath+"/job/:job/*labels", Push(m, opts))
+	router.DELETE(pushAPIPath+"/job/:job/*labels", Delete(m, opts))
+	router.PUT(pushAPIPath+"/job/:job", Push(m, opts))
+	router.POST(pushAPIPath+"/job/:job", Push(m, opts))
+	router.DELETE(pushAPIPath+"/job/:job", Delete(m, opts))
+	router.PUT(pushAPIPath+"/job"+grouping.Base64Suffix+"/:job_base64/*labels", Push(m, opts))
+	router.POST(pushAPIPath+"/job"+grouping.Base64Suffix+"/:job_base64/*labels", Push(m, opts))
+	router.DELETE(pushAPIPath+"/job"+grouping.Base64Suffix+"/:job_base64/*labels", Delete(m, opts))
+	router.PUT(pushAPIPath+"/job"+grouping.Base64Suffix+"/:job_base64", Push(m, opts))
+	router.POST(pushAPIPath+"/job"+grouping.Base64Suffix+"/:job_base64", Push(m, opts))
+	router.DELETE(pushAPIPath+"/job"+grouping.Base64Suffix+"/:job_base64", Delete(m, opts))
+}
+
+func SetupRoutes(router *httprouter.Router, m *resource.Manager, routePrefix string, opts Options) {
 	router.GET("/", Index)
 
-	pushAPIPath := routePrefix + "/metrics"
-	router.PUT(pushAPIPath+"/job/:job/*labels", Push(m))
-	router.POST(pushAPIPath+"/job/:job/*labels", Push(m))
-	router.DELETE(pushAPIPath+"/job/:job/*labels", Delete(m))
-	router.PUT(pushAPIPath+"/job/:job", Push(m))
-	router.POST(pushAPIPath+"/job/:job", Push(m))
-	router.DELETE(pushAPIPath+"/job/:job", Delete(m))
-	router.GET(routePrefix+"/status", Status)
+	if opts.Tenants.ByPath() {
+		tenantPath := routePrefix + "/tenant/:tenant"
+		pushRoutes(router, tenantPath, m, opts)
+		router.GET(tenantPath+"/status", Status(m, opts))
+		router.GET(tenantPath+"/metrics", Metrics(m, opts))
+		router.GET(tenantPath+"/api/v1/metrics", FederatedMetrics(m, opts))
+		router.GET(tenantPath+"/api/v1/status", FederatedStatus(m, opts))
+		router.GET(tenantPath+"/sd/targets", Targets(m, opts))
+		if opts.Federate {
+			router.GET(tenantPath+"/federate", Scrape(m, opts))
+		}
+	} else {
+		pushRoutes(router, routePrefix, m, opts)
+	}
+	router.GET(routePrefix+"/api/v1/metrics", FederatedMetrics(m, opts))
+	router.GET(routePrefix+"/api/v1/status", FederatedStatus(m, opts))
+	router.GET(routePrefix+"/sd/targets", Targets(m, opts))
+	router.POST(routePrefix+"/admin/resources", AddResource(m, opts))
+	router.DELETE(routePrefix+"/admin/resources", RemoveResource(m, opts))
+	router.POST(routePrefix+"/admin/resources/drain", DrainResource(m, opts, true))
+	router.POST(routePrefix+"/admin/resources/undrain", DrainResource(m, opts, false))
+	router.POST(routePrefix+"/admin/rebalance", Rebalance(m, opts))
+	router.POST(routePrefix+"/admin/whatif", WhatIf(m, opts))
+	if opts.Federate {
+		router.GET(routePrefix+"/federate", Scrape(m, opts))
+	}
+	router.GET(routePrefix+"/-/healthy", Healthy)
+	router.GET(routePrefix+"/-/ready", Ready(m, opts))
+	router.GET(routePrefix+"/status", Status(m, opts))
+	router.GET(routePrefix+"/metrics", Metrics(m, opts))
 }
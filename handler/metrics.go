@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/bass3m/middleman/resource"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// metricFamily holds the samples of one middleman self-metric
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+type sample struct {
+	labels map[string]string
+	value  float64
+}
+
+func (f *metricFamily) add(labels map[string]string, value float64) {
+	f.samples = append(f.samples, sample{labels: labels, value: value})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func (f *metricFamily) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	for _, s := range f.samples {
+		names := make([]string, 0, len(s.labels))
+		for n := range s.labels {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		pairs := make([]string, 0, len(names))
+		for _, n := range names {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, n, labelEscaper.Replace(s.labels[n])))
+		}
+		if len(pairs) > 0 {
+			fmt.Fprintf(w, "%s{%s} %v\n", f.name, strings.Join(pairs, ","), s.value)
+		} else {
+			fmt.Fprintf(w, "%s %v\n", f.name, s.value)
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Metrics serves middleman's own metrics in the Prometheus text format
+func Metrics(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		resources, jobs, ok := scopedStats(w, r, ps, m, opts)
+		if !ok {
+			return
+		}
+
+		resourceJobs := &metricFamily{name: "middleman_resource_jobs", typ: "gauge",
+			help: "Number of jobs assigned to the resource."}
+		resourceSent := &metricFamily{name: "middleman_resource_pushes_total", typ: "counter",
+			help: "Number of pushes forwarded to the resource."}
+		resourceHealthy := &metricFamily{name: "middleman_resource_healthy", typ: "gauge",
+			help: "Whether the resource passed its last health check."}
+		for _, rs := range resources {
+			labels := map[string]string{"resource": rs.URL}
+			resourceJobs.add(labels, float64(rs.Jobs))
+			resourceSent.add(labels, float64(rs.JobsSent))
+			resourceHealthy.add(labels, boolValue(rs.Healthy))
+		}
+
+		firstSeen := &metricFamily{name: "middleman_job_first_seen_timestamp_seconds", typ: "gauge",
+			help: "Time the job was first pushed."}
+		lastPush := &metricFamily{name: "middleman_job_last_push_timestamp_seconds", typ: "gauge",
+			help: "Time of the job's last push."}
+		pushes := &metricFamily{name: "middleman_job_pushes_total", typ: "counter",
+			help: "Number of pushes of the job."}
+		bytes := &metricFamily{name: "middleman_job_pushed_bytes_total", typ: "counter",
+			help: "Number of body bytes pushed by the job."}
+		status := &metricFamily{name: "middleman_job_last_status", typ: "gauge",
+			help: "HTTP status of the job's last push upstream, 0 if the resource was unreachable."}
+		latency := &metricFamily{name: "middleman_job_last_latency_seconds", typ: "gauge",
+			help: "Upstream latency of the job's last push."}
+		for _, js := range jobs {
+			labels := map[string]string{"client": js.Client, "grouping_key": js.GroupingKey, "resource": js.Resource}
+			if js.Tenant != "" {
+				labels["tenant"] = js.Tenant
+			}
+			firstSeen.add(labels, float64(js.FirstSeen.UnixNano())/1e9)
+			if !js.LastPush.IsZero() {
+				lastPush.add(labels, float64(js.LastPush.UnixNano())/1e9)
+			}
+			pushes.add(labels, float64(js.Pushes))
+			bytes.add(labels, float64(js.Bytes))
+			status.add(labels, float64(js.LastStatus))
+			latency.add(labels, js.LastLatencySeconds)
+		}
+
+		families := []*metricFamily{resourceJobs, resourceSent, resourceHealthy, firstSeen, lastPush,
+			pushes, bytes, status, latency}
+		if opts.Payloads != nil && opts.seesAll(r) {
+			cached := &metricFamily{name: "middleman_payload_cache_entries", typ: "gauge",
+				help: "Number of last pushes cached for replay."}
+			memory, disk := opts.Payloads.Len()
+			cached.add(map[string]string{"location": "memory"}, float64(memory))
+			cached.add(map[string]string{"location": "disk"}, float64(disk))
+			families = append(families, cached)
+		}
+		if opts.Spool != nil && opts.seesAll(r) {
+			records := &metricFamily{name: "middleman_spool_records", typ: "gauge",
+				help: "Number of pushes spooled for the resource."}
+			spooled := &metricFamily{name: "middleman_spool_bytes", typ: "gauge",
+				help: "Size of the pushes spooled for the resource."}
+			for u, d := range opts.Spool.Depth() {
+				labels := map[string]string{"resource": u}
+				records.add(labels, float64(d.Records))
+				spooled.add(labels, float64(d.Bytes))
+			}
+			families = append(families, records, spooled)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, f := range families {
+			f.write(w)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/bass3m/middleman/resource"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness tells whether middleman has started and isn't shutting down. It
+// starts not ready, a nil Readiness is always ready.
+type Readiness struct {
+	ready int32
+}
+
+// SetReady flips the readiness
+func (rd *Readiness) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&rd.ready, v)
+}
+
+// Ready reports whether middleman has started and isn't shutting down
+func (rd *Readiness) Ready() bool {
+	return rd == nil || atomic.LoadInt32(&rd.ready) == 1
+}
+
+// Healthy answers 200 as long as middleman serves requests
+func Healthy(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	fmt.Fprint(w, "Middleman is Healthy.\n")
+}
+
+// Ready answers 200 when middleman can take pushes: it has started, with its
+// config loaded, resources discovered and spool restored, it isn't shutting
+// down and at least one resource is healthy. It answers 503 otherwise so load
+// balancers stop sending it pushes.
+func Ready(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !opts.Readiness.Ready() {
+			http.Error(w, "Middleman is not ready.", http.StatusServiceUnavailable)
+			return
+		}
+		for _, res := range m.ResourceList() {
+			if !res.Unhealthy {
+				fmt.Fprint(w, "Middleman is Ready.\n")
+				return
+			}
+		}
+		http.Error(w, "No healthy resource.", http.StatusServiceUnavailable)
+	}
+}
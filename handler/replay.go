@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bass3m/middleman/grouping"
+	"github.com/bass3m/middleman/payload"
+	"github.com/bass3m/middleman/resource"
+	"github.com/bass3m/middleman/spool"
+	"net/http"
+	"net/url"
+)
+
+// replay sends e, the last push of group k, to res
+func replay(res resource.Resource, k grouping.Key, e payload.Entry) error {
+	req, err := http.NewRequest(e.Method, res.URL.String()+"/metrics"+k.Path(), bytes.NewReader(e.Body))
+	if err != nil {
+		return err
+	}
+	for h, v := range e.Header {
+		req.Header[h] = v
+	}
+	resp, err := res.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// payloadKey is the key of the last push of group k of job in the payload
+// cache, jobs may push many groups
+func payloadKey(job resource.JobKey, k grouping.Key) string {
+	return string(job) + " " + k.String()
+}
+
+// Replay returns a migration hook sending the last push of every group of
+// every moved job to its new resource, so the job's metrics don't vanish
+// until its next push. Once replayed, each group is deleted from the old
+// resource if it is still up. Groups that can't be replayed are left where
+// they are.
+func Replay(cache *payload.Cache) func([]resource.Migration) {
+	return func(moves []resource.Migration) {
+		go func() {
+			deletions := []resource.Deletion{}
+			for _, mv := range moves {
+				for _, k := range mv.Keys {
+					e, ok := cache.Get(payloadKey(mv.Job, k))
+					if !ok {
+						log.Warnf("No push of %v to replay from %v to %v", k, mv.From.URL, mv.To.URL)
+						continue
+					}
+					if err := replay(mv.To, k, e); err != nil {
+						log.Errorf("Failed to replay %v from %v to %v: %v", k, mv.From.URL, mv.To.URL, err)
+						continue
+					}
+					log.Debugf("Replayed %v from %v to %v", k, mv.From.URL, mv.To.URL)
+					if mv.DeleteOld {
+						deletions = append(deletions, resource.Deletion{Resource: mv.From, Key: k})
+					}
+				}
+			}
+			if failed := sendDeletes(deletions); failed > 0 {
+				log.Errorf("%d of %d deletes of moved groups failed", failed, len(deletions))
+			}
+		}()
+	}
+}
+
+// DeleteStale is a stale group hook deleting the groups from the recovered
+// resource still holding them, so they don't linger next to the copies
+// pushed to the resources they failed over to
+func DeleteStale(deletions []resource.Deletion) {
+	go func() {
+		if failed := sendDeletes(deletions); failed > 0 {
+			log.Errorf("%d of %d deletes of stale groups failed", failed, len(deletions))
+		}
+	}()
+}
+
+// Respool returns a migration hook moving the pushes spooled for the old
+// resource of every moved group to the spool of its new resource, so they
+// follow the group instead of being delivered where it no longer is. Pushes
+// of groups whose last push cache replays are dropped instead, the replay
+// is newer. cache is nil without replay.
+func Respool(s *spool.Spooler, cache *payload.Cache) func([]resource.Migration) {
+	return func(moves []resource.Migration) {
+		type route struct{ from, to string }
+		keep := map[route]map[string]bool{}
+		drop := map[string]map[string]bool{}
+		clients := map[string]*http.Client{}
+		for _, mv := range moves {
+			from, to := mv.From.URL.String(), mv.To.URL.String()
+			clients[to] = mv.To.Client
+			for _, k := range mv.Keys {
+				if cache != nil {
+					if _, ok := cache.Get(payloadKey(mv.Job, k)); ok {
+						if drop[from] == nil {
+							drop[from] = map[string]bool{}
+						}
+						drop[from][k.String()] = true
+						continue
+					}
+				}
+				rt := route{from, to}
+				if keep[rt] == nil {
+					keep[rt] = map[string]bool{}
+				}
+				keep[rt][k.String()] = true
+			}
+		}
+		matching := func(groups map[string]bool) func(string) bool {
+			return func(path string) bool {
+				// spooled paths are escaped, routes are matched unescaped
+				if p, err := url.PathUnescape(path); err == nil {
+					path = p
+				}
+				k, err := grouping.ParsePath(path)
+				return err == nil && groups[k.String()]
+			}
+		}
+		for from, groups := range drop {
+			if n, _ := s.Move(from, "", nil, matching(groups)); n > 0 {
+				log.Infof("Dropped %d pushes spooled for %v replayed elsewhere", n, from)
+			}
+		}
+		for rt, groups := range keep {
+			n, err := s.Move(rt.from, rt.to, clients[rt.to], matching(groups))
+			if err != nil {
+				log.Errorf("Failed to move pushes spooled for %v to %v: %v", rt.from, rt.to, err)
+			}
+			if n > 0 {
+				log.Infof("Moved %d pushes spooled for %v to %v", n, rt.from, rt.to)
+			}
+		}
+	}
+}
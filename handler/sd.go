@@ -0,0 +1,24 @@
+package handler
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bass3m/middleman/resource"
+	"github.com/bass3m/middleman/sd"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// Targets serves the healthy resources in the Prometheus http_sd format
+func Targets(m *resource.Manager, opts Options) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		resources, ok := scopedResources(w, r, ps, m, opts)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sd.TargetGroups(resources, nil)); err != nil {
+			log.Error("Error encoding targets:", err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"os"
@@ -8,31 +9,156 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/bass3m/middleman/clientid"
 	"github.com/bass3m/middleman/config"
 	"github.com/bass3m/middleman/dockerapi"
 	"github.com/bass3m/middleman/handler"
+	"github.com/bass3m/middleman/payload"
 	"github.com/bass3m/middleman/resource"
+	"github.com/bass3m/middleman/sd"
+	"github.com/bass3m/middleman/spool"
+	"github.com/bass3m/middleman/tenant"
 	"github.com/julienschmidt/httprouter"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
-func GetResources(c config.Config) (map[string]string, error) {
+// staticResources returns the resources listed in the config file. The
+// resources uris are ignored when docker is enabled.
+func staticResources(c config.Config) []resource.SvrResource {
+	rs := []resource.SvrResource{}
+	for _, p := range c.FileConfig.Pools {
+		for _, u := range p.Uris {
+			rs = append(rs, resource.SvrResource{URI: u.URI, Pool: p.Name, Source: resource.SourceConfig,
+				MaxJobs: u.MaxJobs, MaxSeries: u.MaxSeries, Priority: u.Priority})
+		}
+	}
+	if c.FileConfig.Resources.Docker.Enabled {
+		return rs
+	}
+	for _, u := range c.FileConfig.Resources.Uris {
+		rs = append(rs, resource.SvrResource{URI: u.URI, Source: resource.SourceConfig,
+			MaxJobs: u.MaxJobs, MaxSeries: u.MaxSeries, Priority: u.Priority})
+	}
+	return rs
+}
+
+func GetResources(c config.Config) ([]resource.SvrResource, error) {
+	rs := staticResources(c)
 	if c.FileConfig.Resources.Docker.Enabled == true {
 		log.Infof("Getting resources from docker")
-		uris, err := dockerapi.GetResources(c.FileConfig, c.Client)
+		drs, err := dockerapi.GetResources(c.FileConfig, c.Client)
+		if err != nil {
+			return []resource.SvrResource{}, err
+		}
+		return append(rs, drs...), nil
+	}
+	return rs, nil
+}
+
+// reloadResources re-reads the config file and brings the resources it
+// lists in the manager in line with it. Other settings need a restart.
+func reloadResources(configPath string, m *resource.Manager) error {
+	c, err := config.ReadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	want := map[string]resource.SvrResource{}
+	for _, sr := range staticResources(c) {
+		want[sr.URI] = sr
+	}
+	have := map[string]bool{}
+	for _, r := range m.ResourceList() {
+		u := r.URL.String()
+		if r.Source != resource.SourceConfig {
+			have[u] = true
+			continue
+		}
+		sr, ok := want[u]
+		pool := sr.Pool
+		if pool == "" {
+			pool = resource.DefaultPool
+		}
+		if !ok || pool != r.Pool || sr.Priority != r.Priority {
+			log.Infof("Removing resource %v dropped from the config", u)
+			if err := m.RemoveResourceURL(u); err != nil {
+				log.Error(err)
+			}
+			continue
+		}
+		if sr.MaxJobs != r.MaxJobs || sr.MaxSeries != r.MaxSeries {
+			log.Infof("Changing the limits of resource %v", u)
+			if err := m.SetLimits(u, sr.MaxJobs, sr.MaxSeries); err != nil {
+				log.Error(err)
+			}
+		}
+		have[u] = true
+	}
+	for u, sr := range want {
+		if have[u] {
+			continue
+		}
+		log.Infof("Adding resource %v from the config", u)
+		if err := m.AddResource(sr); err != nil {
+			log.Errorf("Failed to add resource %v: %v", u, err)
+		}
+	}
+	return nil
+}
+
+// CreateManager creates the resource manager described by the config, with
+// its pools and rules but no resources yet
+func CreateManager(c config.Config) (*resource.Manager, error) {
+	var err error
+	m := resource.CreateBalancer([]resource.SvrResource{}, c.FileConfig.Middleman.Algorithm)
+	identity := c.FileConfig.Middleman.Identity
+	if m.Identity, err = resource.NewIdentity(identity.Mode, identity.Template); err != nil {
+		return nil, err
+	}
+	affinity := c.FileConfig.Middleman.Affinity
+	if m.Affinity, err = resource.NewAffinity(affinity.Level, affinity.Label); err != nil {
+		return nil, err
+	}
+	for _, p := range c.FileConfig.Pools {
+		if err := m.AddPool(p.Name, p.Algorithm); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range c.FileConfig.Rules {
+		rule, err := resource.NewRule(r.Pool, r.Job, r.Labels, r.CIDRs)
 		if err != nil {
-			return map[string]string{}, err
+			return nil, err
 		}
-		return uris, nil
-	} else {
-		rs := map[string]string{}
-		for _, u := range c.FileConfig.Resources.Uris {
-			rs[u] = ""
+		if err := m.AddRule(rule); err != nil {
+			return nil, err
 		}
-		return rs, nil
 	}
+	return m, nil
+}
+
+// CreateTenants registers the configured tenants with the manager, it returns
+// nil when no tenants are configured
+func CreateTenants(c config.Config, m *resource.Manager) (*tenant.Registry, error) {
+	tc := c.FileConfig.Tenants
+	if len(tc.List) == 0 {
+		return nil, nil
+	}
+	reg, err := tenant.NewRegistry(tc.IdentifyBy, tc.Header, tc.AdminToken)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tc.List {
+		if err := reg.Add(&tenant.Tenant{Name: t.Name, Token: t.Token, Pool: t.Pool,
+			MaxJobs: t.MaxJobs, PushRate: t.PushRate}, t.PushBurst); err != nil {
+			return nil, err
+		}
+		if err := m.AddTenant(t.Name, t.Pool, t.MaxJobs); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
 }
 
 func main() {
@@ -42,9 +168,45 @@ func main() {
 		listenAddress = app.Flag("web.listen-address", "Address to listen on for the web interface and API.").Default(":9723").String()
 		routePrefix   = app.Flag("web.route-prefix", "Prefix for the internal routes of web endpoints.").Default("").String()
 		configPath    = app.Flag("cfg.path", "Path to YAML configuration file.").Default("/etc/middleman/middleman.yml").String()
+
+		serveCmd = app.Command("serve", "Run middleman.").Default()
+
+		whatIfCmd       = app.Command("whatif", "Show what a change of resources would do to the jobs of a running middleman.")
+		whatIfURL       = whatIfCmd.Flag("url", "URL of the running middleman, with its route prefix.").Default("http://localhost:9723").String()
+		whatIfToken     = whatIfCmd.Flag("admin-token", "Admin token of the running middleman.").String()
+		whatIfAdd       = whatIfCmd.Flag("add", "URI of a resource to add, repeatable.").Strings()
+		whatIfPool      = whatIfCmd.Flag("pool", "Pool of the resources to add.").String()
+		whatIfRemove    = whatIfCmd.Flag("remove", "URL or id of a resource to remove, repeatable.").Strings()
+		whatIfRebalance = whatIfCmd.Flag("rebalance", "Rebalance once the resources have changed.").Bool()
+
+		simulateCmd       = app.Command("simulate", "Simulate balancing jobs over resources, offline.")
+		simulateJobs      = simulateCmd.Flag("jobs", "File of push paths to balance, one per line optionally followed by the client host. Synthetic jobs when empty.").String()
+		simulateSynthetic = simulateCmd.Flag("synthetic", "Number of synthetic jobs.").Default("10000").Int()
+		simulateResources = simulateCmd.Flag("resources", "Number of resources.").Default("4").Int()
+		simulateAlgorithm = simulateCmd.Flag("algorithm", "Balancing algorithm.").Default("least").String()
+		simulateAdd       = simulateCmd.Flag("add", "Number of resources to add once the jobs are placed.").Default("1").Int()
+		simulateRemove    = simulateCmd.Flag("remove", "Number of resources to remove after that.").Default("1").Int()
+		simulateRebalance = simulateCmd.Flag("rebalance", "Rebalance after every change.").Bool()
 	)
 	app.HelpFlag.Short('h')
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	case serveCmd.FullCommand():
+	case simulateCmd.FullCommand():
+		if err := runSimulate(os.Stdout, *simulateJobs, *simulateSynthetic, *simulateResources, *simulateAlgorithm,
+			*simulateAdd, *simulateRemove, *simulateRebalance); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case whatIfCmd.FullCommand():
+		change := resource.Change{Remove: *whatIfRemove, Rebalance: *whatIfRebalance}
+		for _, u := range *whatIfAdd {
+			change.Add = append(change.Add, resource.SvrResource{URI: u, Pool: *whatIfPool})
+		}
+		if err := runWhatIf(os.Stdout, *whatIfURL, *whatIfToken, change); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	if *routePrefix == "/" {
 		*routePrefix = ""
@@ -66,56 +228,203 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// if using docker, set it up, pass it channel so it sends us events ?
+	// cancelled on shutdown to stop the goroutines watching resources
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := &handler.Readiness{}
+
+	// if using docker, set it up, it sends us container events
+	var resourceChan chan *dockerapi.Event
 	if c.FileConfig.Resources.Docker.Enabled == true {
-		resourceChan := make(chan *dockerapi.Event)
-		defer func() {
-			close(resourceChan)
-		}()
-		dockerapi.SetupDocker(&c, resourceChan)
-		go handleResourceEvents(resourceChan)
+		resourceChan = make(chan *dockerapi.Event)
+		dockerapi.SetupDocker(ctx, &c, resourceChan)
 	}
 
-	uris, err := GetResources(c)
+	// create resource balancer
+	m, err := CreateManager(c)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Infof("Found the following resources: %v", uris)
-	// create resource balancer
-	m := resource.CreateBalancer(uris, c.FileConfig.Middleman.Algorithm)
+	rs, err := GetResources(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Found the following resources: %v", rs)
+	for _, sr := range rs {
+		if err := m.AddResource(sr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// the resources we start with need no warm up
+	m.WarmUp = c.FileConfig.Resources.WarmUp
+	if resourceChan != nil {
+		go handleResourceEvents(m, resourceChan)
+	}
+	if hc := c.FileConfig.Resources.HealthCheck; hc.Interval > 0 {
+		if hc.Timeout <= 0 {
+			hc.Timeout = hc.Interval
+		}
+		m.OnStale(handler.DeleteStale)
+		go m.CheckHealth(ctx, hc.Interval, hc.Timeout)
+	}
 
+	clients, err := clientid.NewResolver(c.FileConfig.Middleman.Client.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tenants, err := CreateTenants(c, m)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if f := c.FileConfig.ServiceDiscovery.File; f.Path != "" {
+		w, err := sd.NewFileWriter(f.Path, f.Format, f.Labels)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go w.Watch(ctx, m)
+	}
+	go reloadHandler(*configPath, m)
+
+	var payloads *payload.Cache
+	if rc := c.FileConfig.Middleman.Replay; rc.Enabled {
+		if payloads, err = payload.NewCache(rc.MaxEntries, rc.MaxMemoryBytes, rc.SpillDir); err != nil {
+			log.Fatal(err)
+		}
+		m.OnMigrate(handler.Replay(payloads))
+	}
+
+	if rb := c.FileConfig.Middleman.Rebalance; rb.Skew > 0 {
+		if payloads == nil {
+			log.Fatal("Automatic rebalancing needs replay enabled")
+		}
+		if rb.Interval <= 0 {
+			log.Fatal("Automatic rebalancing needs an interval")
+		}
+		go m.AutoRebalance(ctx, rb.Interval, rb.Skew)
+	}
+
+	var spooler *spool.Spooler
+	if sc := c.FileConfig.Middleman.Spool; sc.Dir != "" {
+		if spooler, err = spool.New(sc.Dir, sc.MaxBytes, sc.MaxAge); err != nil {
+			log.Fatal(err)
+		}
+		m.OnMigrate(handler.Respool(spooler, payloads))
+	}
+
+	if c.FileConfig.Middleman.AdminToken == "" && c.FileConfig.Tenants.AdminToken == "" {
+		log.Warn("No admin token configured, the admin API is open to everyone")
+	}
 	router := httprouter.New()
-	handler.SetupRoutes(router, m, *routePrefix)
+	deletes := c.FileConfig.Middleman.Delete
+	switch deletes.Mode {
+	case "", "exact", "prefix":
+	default:
+		log.Fatalf("Unrecognized delete mode %v", deletes.Mode)
+	}
+	handler.SetupRoutes(router, m, *routePrefix, handler.Options{Clients: clients,
+		Tenants:                 tenants,
+		DeletePrefix:            deletes.Mode == "prefix",
+		BroadcastUnknownDeletes: deletes.BroadcastUnknown,
+		ValidatePushes:          c.FileConfig.Middleman.Validation.Enabled,
+		Payloads:                payloads,
+		Spool:                   spooler,
+		Federate:                c.FileConfig.Middleman.Federate.Enabled,
+		Readiness:               ready,
+		AdminToken:              c.FileConfig.Middleman.AdminToken})
 
 	l, err := net.Listen("tcp", *listenAddress)
 	if err != nil {
 		log.Fatal(err)
 	}
-	go interruptHandler(l)
-	err = (&http.Server{Addr: *listenAddress, Handler: router}).Serve(l)
-	log.Errorln("Middleman HTTP server stopped:", err)
+	if c.FileConfig.Middleman.Client.ProxyProtocol {
+		l = clientid.NewProxyListener(l, clients)
+	}
+	grace := c.FileConfig.Middleman.Shutdown.GracePeriod
+	if grace <= 0 {
+		grace = defaultGracePeriod
+	}
+	server := &http.Server{Addr: *listenAddress, Handler: router}
+	stopped := make(chan struct{})
+	go interruptHandler(server, ready, cancel, c.FileConfig.Middleman.Shutdown.ReadyDelay, grace, stopped)
+	// the config is loaded, resources discovered and the spool restored
+	ready.SetReady(true)
+	if err := server.Serve(l); err != http.ErrServerClosed {
+		log.Fatalln("Middleman HTTP server stopped:", err)
+	}
+	<-stopped
+	if spooler != nil {
+		// spooled pushes are on disk already, they are delivered next run
+		spooler.Close()
+	}
+	log.Info("Middleman stopped")
 }
 
-func handleResourceEvents(resourceChan <-chan *dockerapi.Event) {
+func handleResourceEvents(m *resource.Manager, resourceChan <-chan *dockerapi.Event) {
 	log.Infof("handleResourceEvents go routine")
-	for {
-		select {
-		case event := <-resourceChan:
-			log.Infof("Got resource event: %+v", event)
-			// XXX add switch to handle msg
-			//resourceChan <- &Event{action: event.Action, name: event.Actor.Atttributes.name, id: event.Actor.ID}
-			// should be adding or deleting resources here
-			//		m.AddResource(r)
+	for event := range resourceChan {
+		log.Infof("Got resource event: %+v", event)
+		switch event.Action {
+		case "start":
+			if event.URI == "" {
+				log.Warnf("No URI for started resource %v", event.ID)
+				continue
+			}
+			sr := resource.SvrResource{URI: event.URI, ID: event.ID, Name: event.Name, Pool: event.Pool,
+				Source: resource.SourceDocker, MaxJobs: event.MaxJobs, MaxSeries: event.MaxSeries,
+				Priority: event.Priority}
+			if err := m.AddResource(sr); err != nil {
+				log.Errorf("Failed to add resource %v: %v", event.URI, err)
+			}
+		case "die":
+			if err := m.RemoveResource(event.ID); err != nil {
+				log.Errorf("Failed to remove resource %v: %v", event.ID, err)
+			}
 		}
 	}
-	return
 }
 
-func interruptHandler(l net.Listener) {
-	notifier := make(chan os.Signal)
+// reloadHandler reloads the resources of the config file on SIGHUP
+func reloadHandler(configPath string, m *resource.Manager) {
+	notifier := make(chan os.Signal, 1)
+	signal.Notify(notifier, syscall.SIGHUP)
+	for range notifier {
+		log.Info("Middleman Received SIGHUP; reloading resources ...")
+		if err := reloadResources(configPath, m); err != nil {
+			log.Errorf("Failed to reload %v: %v", configPath, err)
+		}
+	}
+}
+
+// defaultGracePeriod is how long in-flight requests get to complete on
+// shutdown when the config doesn't say
+const defaultGracePeriod = 30 * time.Second
+
+// shutdown stops being ready first and keeps serving for readyDelay so load
+// balancers notice, then stops the goroutines watching resources and gives
+// in-flight requests grace to complete
+func shutdown(server *http.Server, ready *handler.Readiness, cancel context.CancelFunc,
+	readyDelay time.Duration, grace time.Duration) {
+	ready.SetReady(false)
+	time.Sleep(readyDelay)
+	cancel()
+	ctx, done := context.WithTimeout(context.Background(), grace)
+	defer done()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("In-flight requests did not complete within %v: %v", grace, err)
+	}
+}
+
+// interruptHandler shuts middleman down on SIGINT or SIGTERM, stopped is
+// closed once done
+func interruptHandler(server *http.Server, ready *handler.Readiness, cancel context.CancelFunc,
+	readyDelay time.Duration, grace time.Duration, stopped chan<- struct{}) {
+	notifier := make(chan os.Signal, 1)
 	signal.Notify(notifier, os.Interrupt, syscall.SIGTERM)
 	<-notifier
-	log.Info("Middleman Received SIGINT/SIGTERM; exiting ...")
-	l.Close()
+	log.Info("Middleman Received SIGINT/SIGTERM; shutting down ...")
+	shutdown(server, ready, cancel, readyDelay, grace)
+	close(stopped)
 }
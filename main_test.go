@@ -1,13 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bass3m/middleman/clientid"
+	"github.com/bass3m/middleman/config"
+	"github.com/bass3m/middleman/grouping"
 	"github.com/bass3m/middleman/handler"
+	"github.com/bass3m/middleman/payload"
 	"github.com/bass3m/middleman/resource"
+	"github.com/bass3m/middleman/sd"
+	"github.com/bass3m/middleman/spool"
+	"github.com/bass3m/middleman/tenant"
 	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const checkMark = "\u2713"
@@ -17,22 +35,31 @@ var m *resource.Manager
 var router *httprouter.Router
 
 func setup(uris []string, algo string) {
-	m = resource.Create(uris, algo)
+	rs := []resource.SvrResource{}
+	for _, u := range uris {
+		rs = append(rs, resource.SvrResource{URI: u})
+	}
+	m = resource.CreateBalancer(rs, algo)
 
 	router = httprouter.New()
-	handler.SetupRoutes(router, m, "")
+	handler.SetupRoutes(router, m, "", handler.Options{})
 }
 
 func TestConfig(t *testing.T) {
 	t.Log("Given the need to test reading config.")
-	var c Config
-	c.ReadConfig("./middleman_test.yml")
+	c, err := config.ReadConfig("./middleman_test.yml")
+	if err != nil {
+		t.Fatal("\tShould be able to read config", ballotX, err)
+	}
 
 	// create resource manager
-	m = resource.Create(c.Resources.Uris, c.Middleman.Algorithm)
+	rs, err := GetResources(c)
+	if err != nil {
+		t.Fatal("\tShould be able to get resources", ballotX, err)
+	}
+	m = resource.CreateBalancer(rs, c.FileConfig.Middleman.Algorithm)
 
-	rs := m.Resources
-	if len(rs) != 8 {
+	if len(m.Resources) != 8 {
 		t.Fatal("\tShould have created 8 resources", ballotX)
 	}
 	t.Log("\tShould have created 8 resources", checkMark)
@@ -219,12 +246,1670 @@ func TestDeleteJob(t *testing.T) {
 		t.Fatal("\tShould receive \"200\"", ballotX, w.Code)
 	}
 
-	u, err := url.Parse("/metrics/job/nodeexporter/instance/myhostname1")
+	k, err := grouping.ParsePath("/metrics/job/nodeexporter/instance/myhostname1")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if m.JobExists(req.RemoteAddr, u) {
+	if m.JobExists("", req.RemoteAddr, k) {
 		t.Fatal("\tJob not deleted", ballotX, req.RemoteAddr, "/metrics/job/nodeexporter/instance/myhostname1")
 	}
 	t.Log("Was able to delete job successfully", checkMark)
 }
+
+func TestJobStats(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gw.Close()
+	setup([]string{gw.URL}, "least")
+
+	t.Log("Given the need to test per job push statistics.")
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/metrics/job/nodeexporter/instance/myhostname1",
+			strings.NewReader("some_metric 1\n"))
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		router.ServeHTTP(w, req)
+	}
+	stats := m.JobStats()
+	if len(stats) != 1 {
+		t.Fatal("\tShould have stats for 1 job", ballotX, len(stats))
+	}
+	t.Log("\tShould have stats for 1 job", checkMark)
+	js := stats[0]
+	if js.Pushes != 2 || js.Bytes != 28 {
+		t.Fatal("\tShould have recorded 2 pushes of 28 bytes", ballotX, js.Pushes, js.Bytes)
+	}
+	t.Log("\tShould have recorded 2 pushes of 28 bytes", checkMark)
+	if js.LastStatus != http.StatusAccepted {
+		t.Fatal("\tShould have recorded the upstream status", ballotX, js.LastStatus)
+	}
+	t.Log("\tShould have recorded the upstream status", checkMark)
+	if js.FirstSeen.IsZero() || js.LastPush.Before(js.FirstSeen) {
+		t.Fatal("\tShould have recorded first seen and last push times", ballotX, js.FirstSeen, js.LastPush)
+	}
+	t.Log("\tShould have recorded first seen and last push times", checkMark)
+}
+
+func benchmarkFindResource(b *testing.B, jobs int) {
+	rs := []resource.SvrResource{}
+	for i := 0; i < 8; i++ {
+		rs = append(rs, resource.SvrResource{URI: fmt.Sprintf("http://localhost:%d", 9091+i)})
+	}
+	bm := resource.CreateBalancer(rs, "least")
+	ks := make([]grouping.Key, jobs)
+	for i := range ks {
+		k, err := grouping.Parse("nodeexporter", false, fmt.Sprintf("/instance/myhostname%d", i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		ks[i] = k
+		if _, err := bm.FindResource("", "10.0.0.1", k); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bm.FindResource("", "10.0.0.1", ks[i%jobs]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFindResource shows the cost of looking up an existing job does
+// not grow with the number of jobs.
+func BenchmarkFindResource(b *testing.B) {
+	for _, jobs := range []int{100, 10000, 100000} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			benchmarkFindResource(b, jobs)
+		})
+	}
+}
+
+func TestGroupingKey(t *testing.T) {
+	setup([]string{
+		"http://localhost:9091",
+		"http://localhost:1909",
+	}, "least")
+
+	t.Log("Given the need to identify jobs by their canonical grouping key.")
+	requests := []string{
+		"/metrics/job/a/instance/x/env/p",
+		"/metrics/job/a/env/p/instance/x",
+		"/metrics/job/a/env/p/instance/x/",
+		"/metrics/job/a/env@base64/cA/instance/x",
+		"/metrics/job@base64/YQ==/env/p/instance/x",
+	}
+	for _, u := range requests {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", u, nil)
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatal("\tShould receive \"200\"", ballotX, u, w.Code)
+		}
+	}
+	stats := m.JobStats()
+	if len(stats) != 1 {
+		t.Fatal("\tShould have created 1 job", ballotX, len(stats))
+	}
+	t.Log("\tShould have created 1 job", checkMark)
+	if stats[0].GroupingKey != `{job="a",env="p",instance="x"}` {
+		t.Fatal("\tShould have a sorted grouping key", ballotX, stats[0].GroupingKey)
+	}
+	t.Log("\tShould have a sorted grouping key", checkMark)
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/metrics/job/a/instance", nil)
+	if err != nil {
+		t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatal("\tShould receive \"400\" for an odd label path", ballotX, w.Code)
+	}
+	t.Log("\tShould receive \"400\" for an odd label path", checkMark)
+}
+
+func TestIdentityGroup(t *testing.T) {
+	setup([]string{
+		"http://localhost:9091",
+		"http://localhost:1909",
+	}, "least")
+	var err error
+	if m.Identity, err = resource.NewIdentity(resource.IdentityGroup, ""); err != nil {
+		t.Fatal("\tShould be able to create the group identity", ballotX, err)
+	}
+
+	t.Log("Given the need to identify jobs without the client host.")
+	for _, addr := range []string{"10.0.0.1:4242", "10.0.0.2:4242"} {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/metrics/job/cron/instance/batch", nil)
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		req.RemoteAddr = addr
+		router.ServeHTTP(w, req)
+	}
+	stats := m.JobStats()
+	if len(stats) != 1 || stats[0].Client != "10.0.0.2" {
+		t.Fatal("\tShould have created 1 job pushed last by 10.0.0.2", ballotX, stats)
+	}
+	t.Log("\tShould have created 1 job pushed last by 10.0.0.2", checkMark)
+}
+
+func TestClientIdentity(t *testing.T) {
+	t.Log("Given the need to identify clients behind proxies.")
+	clients, err := clientid.NewResolver([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal("\tShould be able to create a resolver", ballotX, err)
+	}
+	tests := []struct {
+		remoteAddr string
+		header     string
+		value      string
+		client     string
+	}{
+		{"[2001:db8::1]:4242", "", "", "2001:db8::1"},
+		{"192.168.0.1:4242", "X-Forwarded-For", "1.2.3.4", "192.168.0.1"},
+		{"10.0.0.1:4242", "X-Forwarded-For", "1.2.3.4, 10.0.0.2", "1.2.3.4"},
+		{"[::1]:4242", "Forwarded", `for="[2001:db8::2]:1234";proto=http`, "2001:db8::2"},
+		{"10.0.0.1:4242", "X-Real-IP", "5.6.7.8", "5.6.7.8"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("PUT", "/metrics/job/a", nil)
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		req.RemoteAddr = tt.remoteAddr
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		if c := clients.Client(req); c != tt.client {
+			t.Fatal("\tShould resolve the client", ballotX, tt, c)
+		}
+	}
+	t.Log("\tShould resolve the client", checkMark)
+}
+
+func TestAffinityJob(t *testing.T) {
+	setup([]string{
+		"http://localhost:9091",
+		"http://localhost:1909",
+		"http://localhost:9092",
+		"http://localhost:19092",
+	}, "least")
+	var err error
+	if m.Affinity, err = resource.NewAffinity(resource.AffinityJob, ""); err != nil {
+		t.Fatal("\tShould be able to create the job affinity", ballotX, err)
+	}
+
+	t.Log("Given the need to keep every instance of a job on one resource.")
+	for i := 0; i < 4; i++ {
+		for _, job := range []string{"cadvisor", "nodeexporter"} {
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest("PUT", fmt.Sprintf("/metrics/job/%s/instance/myhostname%d", job, i), nil)
+			if err != nil {
+				t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+			}
+			router.ServeHTTP(w, req)
+		}
+	}
+	resources := map[string]map[string]bool{}
+	for _, js := range m.JobStats() {
+		job := strings.SplitN(js.GroupingKey, ",", 2)[0]
+		if resources[job] == nil {
+			resources[job] = map[string]bool{}
+		}
+		resources[job][js.Resource] = true
+	}
+	for job, rs := range resources {
+		if len(rs) != 1 {
+			t.Fatal("\tShould have placed every group of the job on one resource", ballotX, job, rs)
+		}
+	}
+	t.Log("\tShould have placed every group of the job on one resource", checkMark)
+	if len(m.JobStats()) != 8 {
+		t.Fatal("\tShould still track 8 groups", ballotX, len(m.JobStats()))
+	}
+	t.Log("\tShould still track 8 groups", checkMark)
+}
+
+func TestPoolRules(t *testing.T) {
+	setup([]string{
+		"http://localhost:9091",
+		"http://localhost:1909",
+	}, "least")
+	t.Log("Given the need to route jobs to resource pools.")
+	if err := m.AddPool("ha", "least"); err != nil {
+		t.Fatal("\tShould be able to add a pool", ballotX, err)
+	}
+	if err := m.AddResource(resource.SvrResource{URI: "http://localhost:9092", Pool: "ha"}); err != nil {
+		t.Fatal("\tShould be able to add a resource to the pool", ballotX, err)
+	}
+	rule, err := resource.NewRule("ha", "", map[string]string{"env": "prod|staging"}, nil)
+	if err != nil {
+		t.Fatal("\tShould be able to create a rule", ballotX, err)
+	}
+	if err := m.AddRule(rule); err != nil {
+		t.Fatal("\tShould be able to add a rule", ballotX, err)
+	}
+	t.Log("\tShould be able to set up the ha pool", checkMark)
+
+	for i := 0; i < 4; i++ {
+		for _, env := range []string{"prod", "dev"} {
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest("PUT", fmt.Sprintf("/metrics/job/app/instance/myhostname%d/env/%s", i, env), nil)
+			if err != nil {
+				t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+			}
+			router.ServeHTTP(w, req)
+		}
+	}
+	for _, js := range m.JobStats() {
+		prod := strings.Contains(js.GroupingKey, `env="prod"`)
+		if prod != (js.Resource == "http://localhost:9092") {
+			t.Fatal("\tShould send only prod jobs to the ha pool", ballotX, js.GroupingKey, js.Resource)
+		}
+	}
+	t.Log("\tShould send only prod jobs to the ha pool", checkMark)
+}
+
+func TestTenants(t *testing.T) {
+	setup([]string{
+		"http://localhost:9091",
+	}, "least")
+	t.Log("Given the need to isolate tenants.")
+	tenants, err := tenant.NewRegistry(tenant.ByHeader, "", "admin")
+	if err != nil {
+		t.Fatal("\tShould be able to create a tenant registry", ballotX, err)
+	}
+	for _, name := range []string{"team-a", "team-b"} {
+		if err := tenants.Add(&tenant.Tenant{Name: name, MaxJobs: 2}, 0); err != nil {
+			t.Fatal("\tShould be able to add a tenant", ballotX, err)
+		}
+		if err := m.AddTenant(name, "", 2); err != nil {
+			t.Fatal("\tShould be able to add a tenant", ballotX, err)
+		}
+	}
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{Tenants: tenants})
+
+	push := func(tenant string, instance int) int {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", fmt.Sprintf("/metrics/job/app/instance/myhostname%d", instance), nil)
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		if tenant != "" {
+			req.Header.Set(tenants.Header(), tenant)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := push("", 0); code != http.StatusUnauthorized {
+		t.Fatal("\tShould refuse pushes without a tenant", ballotX, code)
+	}
+	t.Log("\tShould refuse pushes without a tenant", checkMark)
+	for i := 0; i < 2; i++ {
+		if code := push("team-a", i); code != 200 {
+			t.Fatal("\tShould accept pushes within the quota", ballotX, code)
+		}
+	}
+	if code := push("team-a", 2); code != http.StatusForbidden {
+		t.Fatal("\tShould refuse jobs past the quota", ballotX, code)
+	}
+	t.Log("\tShould refuse jobs past the quota", checkMark)
+	if code := push("team-b", 0); code != 200 {
+		t.Fatal("\tShould keep the same group of another tenant apart", ballotX, code)
+	}
+	if len(m.JobStats()) != 3 {
+		t.Fatal("\tShould keep the same group of another tenant apart", ballotX, len(m.JobStats()))
+	}
+	t.Log("\tShould keep the same group of another tenant apart", checkMark)
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/status", nil)
+	if err != nil {
+		t.Fatal("\tShould be able to create a GET request", ballotX, err)
+	}
+	req.Header.Set(tenants.Header(), "team-b")
+	router.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), "team-a") {
+		t.Fatal("\tShould only show a tenant its own jobs", ballotX, w.Body.String())
+	}
+	t.Log("\tShould only show a tenant its own jobs", checkMark)
+}
+
+func TestDeletePrefix(t *testing.T) {
+	var mux sync.Mutex
+	deleted := map[string]bool{}
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			mux.Lock()
+			deleted[r.URL.Path] = true
+			mux.Unlock()
+		}
+	}))
+	defer gw.Close()
+	setup([]string{gw.URL + "/a", gw.URL + "/b"}, "least")
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{DeletePrefix: true})
+
+	t.Log("Given the need to delete every group of a job.")
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", fmt.Sprintf("/metrics/job/foo/instance/myhostname%d", i), strings.NewReader(""))
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		router.ServeHTTP(w, req)
+	}
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "/metrics/job/foo", nil)
+	if err != nil {
+		t.Fatal("\tShould be able to create a DELETE request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	if len(m.JobStats()) != 0 {
+		t.Fatal("\tShould have forgotten every group of the job", ballotX, len(m.JobStats()))
+	}
+	t.Log("\tShould have forgotten every group of the job", checkMark)
+	if len(deleted) != 4 {
+		t.Fatal("\tShould have sent a delete for every group", ballotX, deleted)
+	}
+	t.Log("\tShould have sent a delete for every group", checkMark)
+}
+
+func TestFederatedMetrics(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a/api/v1/metrics":
+			fmt.Fprint(w, `{"status":"success","data":[{"labels":{"job":"foo"},"last_push_successful":true}]}`)
+		case "/b/api/v1/metrics":
+			fmt.Fprint(w, `{"status":"success","data":[{"labels":{"job":"bar"}}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer gw.Close()
+	setup([]string{gw.URL + "/a", gw.URL + "/b", gw.URL + "/c"}, "least")
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{})
+
+	t.Log("Given the need to read the groups of every resource at once.")
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/v1/metrics", nil)
+	if err != nil {
+		t.Fatal("\tShould be able to create a GET request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	var resp struct {
+		Status string `json:"status"`
+		Data   []struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal("\tShould receive a JSON answer", ballotX, err)
+	}
+	if len(resp.Data) != 2 {
+		t.Fatal("\tShould have merged the groups of every resource", ballotX, resp.Data)
+	}
+	t.Log("\tShould have merged the groups of every resource", checkMark)
+	for _, g := range resp.Data {
+		want := gw.URL + "/a"
+		if g.Labels["job"] == "bar" {
+			want = gw.URL + "/b"
+		}
+		if g.Labels[handler.ResourceLabel] != want {
+			t.Fatal("\tShould label every group with its resource", ballotX, g.Labels)
+		}
+	}
+	t.Log("\tShould label every group with its resource", checkMark)
+	if len(resp.Warnings) != 1 {
+		t.Fatal("\tShould warn about the failing resource", ballotX, resp.Warnings)
+	}
+	t.Log("\tShould warn about the failing resource", checkMark)
+}
+
+func TestFederateScrape(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a/metrics", "/b/metrics":
+			fmt.Fprint(w, "# HELP push_time_seconds Last push.\n# TYPE push_time_seconds gauge\n")
+			fmt.Fprintf(w, "push_time_seconds{job=%q} 1\n", r.URL.Path[1:2])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer gw.Close()
+	setup([]string{gw.URL + "/a", gw.URL + "/b", gw.URL + "/c", gw.URL + "/d"}, "least")
+	m.SetHealthy(gw.URL+"/d", false)
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{Federate: true})
+
+	t.Log("Given the need to scrape every resource at once.")
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/federate", nil)
+	if err != nil {
+		t.Fatal("\tShould be able to create a GET request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	body := w.Body.String()
+	if strings.Count(body, "# TYPE push_time_seconds") != 1 {
+		t.Fatal("\tShould dedupe TYPE lines", ballotX, body)
+	}
+	t.Log("\tShould dedupe TYPE lines", checkMark)
+	want := fmt.Sprintf(`push_time_seconds{%s="%s/b",job="b"} 1`, handler.ResourceLabel, gw.URL)
+	if !strings.Contains(body, want) {
+		t.Fatal("\tShould label every sample with its resource", ballotX, body)
+	}
+	t.Log("\tShould label every sample with its resource", checkMark)
+	if !strings.Contains(body, fmt.Sprintf(`middleman_scrape_up{resource="%s/c"} 0`, gw.URL)) {
+		t.Fatal("\tShould report the failed scrape", ballotX, body)
+	}
+	t.Log("\tShould report the failed scrape", checkMark)
+	if strings.Contains(body, gw.URL+"/d") {
+		t.Fatal("\tShould skip unhealthy resources", ballotX, body)
+	}
+	t.Log("\tShould skip unhealthy resources", checkMark)
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	m = resource.CreateBalancer([]resource.SvrResource{
+		{URI: "http://10.0.0.1:9091", ID: "abc", Name: "pushgateway-1"},
+		{URI: "http://10.0.0.2:9091", ID: "def", Name: "pushgateway-2"}}, "least")
+	m.SetHealthy("http://10.0.0.2:9091", false)
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{})
+
+	t.Log("Given the need to discover the resources to scrape.")
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/sd/targets", nil)
+	if err != nil {
+		t.Fatal("\tShould be able to create a GET request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	var groups []sd.TargetGroup
+	if err := json.NewDecoder(w.Body).Decode(&groups); err != nil {
+		t.Fatal("\tShould receive http_sd JSON", ballotX, err)
+	}
+	if len(groups) != 1 || len(groups[0].Targets) != 1 || groups[0].Targets[0] != "10.0.0.1:9091" {
+		t.Fatal("\tShould list the healthy resources only", ballotX, groups)
+	}
+	t.Log("\tShould list the healthy resources only", checkMark)
+	labels := groups[0].Labels
+	if labels["__meta_middleman_resource_id"] != "abc" || labels["__meta_middleman_container_name"] != "pushgateway-1" ||
+		labels["__meta_middleman_pool"] != resource.DefaultPool {
+		t.Fatal("\tShould label targets with their id, container and pool", ballotX, labels)
+	}
+	t.Log("\tShould label targets with their id, container and pool", checkMark)
+}
+
+func TestFileSD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "middleman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets.json")
+	setup([]string{"http://10.0.0.1:9091"}, "least")
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{})
+	fw, err := sd.NewFileWriter(path, "", map[string]string{"env": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go fw.Watch(ctx, m)
+
+	targets := func() []sd.TargetGroup {
+		var groups []sd.TargetGroup
+		for i := 0; i < 100; i++ {
+			b, err := ioutil.ReadFile(path)
+			if err == nil && json.Unmarshal(b, &groups) == nil && len(groups) == 2 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return groups
+	}
+
+	t.Log("Given the need to write the resources to a file_sd file.")
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/resources", strings.NewReader(`{"uri":"http://10.0.0.2:9091","id":"def"}`))
+	if err != nil {
+		t.Fatal("\tShould be able to create a POST request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatal("\tShould add the resource through the admin API", ballotX, w.Code, w.Body.String())
+	}
+	t.Log("\tShould add the resource through the admin API", checkMark)
+	groups := targets()
+	if len(groups) != 2 {
+		t.Fatal("\tShould rewrite the file when resources change", ballotX, groups)
+	}
+	t.Log("\tShould rewrite the file when resources change", checkMark)
+	if groups[1].Labels["env"] != "test" || groups[1].Labels[sd.IDLabel] != "def" {
+		t.Fatal("\tShould label the targets", ballotX, groups[1].Labels)
+	}
+	t.Log("\tShould label the targets", checkMark)
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatal("\tShould leave no temporary files behind", ballotX, len(files))
+	}
+	t.Log("\tShould leave no temporary files behind", checkMark)
+}
+
+func TestValidatePushes(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer gw.Close()
+	setup([]string{gw.URL}, "least")
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{ValidatePushes: true})
+
+	gauge := []byte{0x12, 0x09, 0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}
+	family := func(metric []byte) string {
+		f := append([]byte{0x0a, 0x03, 'f', 'o', 'o', 0x18, 0x01, 0x22, byte(len(metric))}, metric...)
+		return string(append([]byte{byte(len(f))}, f...))
+	}
+	protoType := "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+	tests := []struct {
+		contentType string
+		body        string
+		valid       bool
+		reason      string
+	}{
+		{"", "# TYPE foo gauge\nfoo{instance=\"a\"} 1\n", true, ""},
+		{"", "foo 1 1500000000000\n", false, "timestamp"},
+		{"", "foo{instance=\"b\"} 1\n", false, "grouping key"},
+		{"", "# TYPE foo gauge\n# TYPE foo counter\nfoo 1\n", false, "TYPE"},
+		{"", "# TYPE foo histogram\nfoo 1\n", false, "histogram"},
+		{"", "foo 1\nbar 1\nfoo{x=\"y\"} 1\n", false, "grouped"},
+		{protoType, family(gauge), true, ""},
+		{protoType, family(append(gauge, 0x30, 0x05)), false, "timestamp"},
+		{protoType, family([]byte{0x1a, 0x09, 0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}), false, "counter value"},
+	}
+
+	t.Log("Given the need to reject invalid pushes.")
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/metrics/job/foo/instance/a", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		req.Header.Set("Content-Type", tt.contentType)
+		router.ServeHTTP(w, req)
+		if tt.valid && w.Code != http.StatusOK {
+			t.Fatal("\tShould accept valid push", i, ballotX, w.Code, w.Body.String())
+		}
+		if !tt.valid && (w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.reason)) {
+			t.Fatal("\tShould reject invalid push with a reason", i, ballotX, w.Code, w.Body.String())
+		}
+	}
+	t.Log("\tShould accept valid pushes and reject invalid ones with a reason", checkMark)
+}
+
+func TestReplayOnDrain(t *testing.T) {
+	var mux sync.Mutex
+	pushed := map[string]string{}
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		pushed[r.URL.Path] = string(b)
+		mux.Unlock()
+	}))
+	defer gw.Close()
+	dir, err := ioutil.TempDir("", "middleman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// no memory to speak of, every payload is spilled
+	cache, err := payload.NewCache(10, 1, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup([]string{gw.URL + "/a", gw.URL + "/b"}, "least")
+	m.OnMigrate(handler.Replay(cache))
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{Payloads: cache})
+
+	t.Log("Given the need to keep a job's metrics when it moves.")
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/metrics/job/batch", strings.NewReader("batch_done 1\n"))
+	if err != nil {
+		t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	from := m.JobStats()[0].Resource
+	to := gw.URL + "/a"
+	if from == to {
+		to = gw.URL + "/b"
+	}
+	if memory, disk := cache.Len(); memory != 0 || disk != 1 {
+		t.Fatal("\tShould spill the payload to disk", ballotX, memory, disk)
+	}
+	t.Log("\tShould spill the payload to disk", checkMark)
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("POST", "/admin/resources/drain?url="+from, nil)
+	if err != nil {
+		t.Fatal("\tShould be able to create a POST request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || m.JobStats()[0].Resource != to {
+		t.Fatal("\tShould move the job off the drained resource", ballotX, w.Code, m.JobStats()[0].Resource)
+	}
+	t.Log("\tShould move the job off the drained resource", checkMark)
+	path := strings.TrimPrefix(to, gw.URL) + "/metrics/job/batch"
+	replayed := ""
+	for i := 0; i < 100 && replayed == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		mux.Lock()
+		replayed = pushed[path]
+		mux.Unlock()
+	}
+	if replayed != "batch_done 1\n" {
+		t.Fatal("\tShould replay the last push to the new resource", ballotX, pushed)
+	}
+	t.Log("\tShould replay the last push to the new resource", checkMark)
+}
+
+func TestSpool(t *testing.T) {
+	var mux sync.Mutex
+	down := true
+	delivered := []string{}
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		defer mux.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered = append(delivered, string(b))
+	}))
+	defer gw.Close()
+	dir, err := ioutil.TempDir("", "middleman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spooler, err := spool.New(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spooler.Close()
+	setup([]string{gw.URL}, "least")
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{Spool: spooler})
+
+	t.Log("Given the need to keep pushes while the gateway is down.")
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/metrics/job/spooled", strings.NewReader(fmt.Sprintf("push %d\n", i)))
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusAccepted {
+			t.Fatal("\tShould accept the push with 202", ballotX, w.Code)
+		}
+	}
+	t.Log("\tShould accept the push with 202", checkMark)
+	if d := spooler.Depth()[gw.URL]; d.Records != 3 {
+		t.Fatal("\tShould spool every push", ballotX, d)
+	}
+	t.Log("\tShould spool every push", checkMark)
+
+	mux.Lock()
+	down = false
+	mux.Unlock()
+	for i := 0; i < 50 && spooler.Depth()[gw.URL].Records > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if strings.Join(delivered, "") != "push 0\npush 1\npush 2\n" {
+		t.Fatal("\tShould deliver the pushes in order once the gateway is back", ballotX, delivered)
+	}
+	t.Log("\tShould deliver the pushes in order once the gateway is back", checkMark)
+}
+
+func TestRebalance(t *testing.T) {
+	var mux sync.Mutex
+	requests := map[string]int{}
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		mux.Lock()
+		requests[r.Method+" "+r.URL.Path[:2]]++
+		mux.Unlock()
+	}))
+	defer gw.Close()
+	cache, err := payload.NewCache(100, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup([]string{gw.URL + "/a"}, "least")
+	m.OnMigrate(handler.Replay(cache))
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{Payloads: cache})
+	for i := 0; i < 6; i++ {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", fmt.Sprintf("/metrics/job/foo/instance/host%d", i), strings.NewReader("foo 1\n"))
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		router.ServeHTTP(w, req)
+	}
+	if err := m.AddResource(resource.SvrResource{URI: gw.URL + "/b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rebalance := func(query string) resource.Plan {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/admin/rebalance"+query, nil)
+		if err != nil {
+			t.Fatal("\tShould be able to create a POST request", ballotX, err)
+		}
+		router.ServeHTTP(w, req)
+		var plan resource.Plan
+		if err := json.NewDecoder(w.Body).Decode(&plan); err != nil {
+			t.Fatal("\tShould receive the plan as JSON", ballotX, err)
+		}
+		return plan
+	}
+
+	t.Log("Given the need to spread existing jobs over new resources.")
+	plan := rebalance("?dry_run=true")
+	if len(plan.Moves) != 3 || plan.After[gw.URL+"/a"] != 3 || plan.After[gw.URL+"/b"] != 3 {
+		t.Fatal("\tShould plan to move as few jobs as needed", ballotX, plan)
+	}
+	t.Log("\tShould plan to move as few jobs as needed", checkMark)
+	if m.ResourceStats()[0].Jobs != 6 {
+		t.Fatal("\tShould move nothing on a dry run", ballotX, m.ResourceStats())
+	}
+	t.Log("\tShould move nothing on a dry run", checkMark)
+
+	plan = rebalance("")
+	if len(plan.Moves) != 3 || m.ResourceStats()[0].Jobs != 3 || m.ResourceStats()[1].Jobs != 3 {
+		t.Fatal("\tShould move the planned jobs", ballotX, m.ResourceStats())
+	}
+	t.Log("\tShould move the planned jobs", checkMark)
+	done := false
+	for i := 0; i < 100 && !done; i++ {
+		time.Sleep(10 * time.Millisecond)
+		mux.Lock()
+		done = requests["PUT /b"] == 3 && requests["DELETE /a"] == 3
+		mux.Unlock()
+	}
+	if !done {
+		t.Fatal("\tShould replay moved jobs and delete them from their old resource", ballotX, requests)
+	}
+	t.Log("\tShould replay moved jobs and delete them from their old resource", checkMark)
+}
+
+func TestWhatIf(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer gw.Close()
+	setup([]string{gw.URL + "/a", gw.URL + "/b"}, "least")
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{})
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", fmt.Sprintf("/metrics/job/foo/instance/host%d", i), strings.NewReader(""))
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		router.ServeHTTP(w, req)
+	}
+	mm := httptest.NewServer(router)
+	defer mm.Close()
+
+	t.Log("Given the need to know what removing a resource would do.")
+	var out bytes.Buffer
+	change := resource.Change{Remove: []string{gw.URL + "/a"}, Add: []resource.SvrResource{{URI: gw.URL + "/c"}}}
+	if err := runWhatIf(&out, mm.URL, "", change); err != nil {
+		t.Fatal("\tShould get an answer from middleman", ballotX, err)
+	}
+	t.Log("\tShould get an answer from middleman", checkMark)
+	if !strings.HasPrefix(out.String(), "2 jobs move, 0 left without a resource\n") {
+		t.Fatal("\tShould move the jobs of the removed resource", ballotX, out.String())
+	}
+	t.Log("\tShould move the jobs of the removed resource", checkMark)
+	if !strings.Contains(out.String(), gw.URL+"/c") {
+		t.Fatal("\tShould report the distribution over the new resources", ballotX, out.String())
+	}
+	t.Log("\tShould report the distribution over the new resources", checkMark)
+	if len(m.ResourceStats()) != 2 || m.ResourceStats()[0].Jobs != 2 {
+		t.Fatal("\tShould leave the manager untouched", ballotX, m.ResourceStats())
+	}
+	t.Log("\tShould leave the manager untouched", checkMark)
+
+	w := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"add":[{"uri":%q,"pool":"default","max_jobs":1}]}`, gw.URL+"/c")
+	req, err := http.NewRequest("POST", "/admin/whatif", strings.NewReader(body))
+	if err != nil {
+		t.Fatal("\tShould be able to create a POST request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	var wi resource.WhatIf
+	if err := json.NewDecoder(w.Body).Decode(&wi); err != nil {
+		t.Fatal("\tShould receive the outcome as JSON", ballotX, err)
+	}
+	if _, ok := wi.After[gw.URL+"/c"]; !ok {
+		t.Fatal("\tShould take resources shaped like POST /admin/resources", ballotX, wi)
+	}
+	t.Log("\tShould take resources shaped like POST /admin/resources", checkMark)
+}
+
+func TestSimulate(t *testing.T) {
+	t.Log("Given the need to compare balancing algorithms offline.")
+	d := newDistStats([]int{0, 0, 0, 10})
+	if d.min != 0 || d.max != 10 || math.Abs(d.gini-0.75) > 1e-9 || math.Abs(d.stddev-4.33) > 0.01 {
+		t.Fatal("\tShould compute the distribution stats", ballotX, d)
+	}
+	t.Log("\tShould compute the distribution stats", checkMark)
+
+	jobs, err := readJobs(strings.NewReader("# recorded jobs\n/metrics/job/foo/instance/a 10.0.0.1\njob/bar\n\n"))
+	if err != nil || len(jobs) != 2 || jobs[0].host != "10.0.0.1" || jobs[1].key.Job != "bar" {
+		t.Fatal("\tShould read recorded jobs", ballotX, jobs, err)
+	}
+	t.Log("\tShould read recorded jobs", checkMark)
+
+	var out bytes.Buffer
+	if err := simulate(&out, syntheticJobs(100), 4, "least", 1, 1, false); err != nil {
+		t.Fatal("\tShould run the simulation", ballotX, err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if !strings.Contains(lines[1], "min 25 max 25") {
+		t.Fatal("\tShould spread the jobs evenly", ballotX, out.String())
+	}
+	t.Log("\tShould spread the jobs evenly", checkMark)
+	if !strings.Contains(lines[2], "churn 0 jobs") || !strings.Contains(lines[3], "churn 25 jobs") {
+		t.Fatal("\tShould report the churn of adds and removals", ballotX, out.String())
+	}
+	t.Log("\tShould report the churn of adds and removals", checkMark)
+}
+
+func TestWarmUp(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer gw.Close()
+	setup([]string{gw.URL + "/a"}, "least")
+	m.WarmUp = 10 * time.Second
+	push := func(from, to int) {
+		for i := from; i < to; i++ {
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest("PUT", fmt.Sprintf("/metrics/job/foo/instance/host%d", i), strings.NewReader("foo 1\n"))
+			if err != nil {
+				t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+			}
+			router.ServeHTTP(w, req)
+		}
+	}
+	push(0, 10)
+	if err := m.AddResource(resource.SvrResource{URI: gw.URL + "/b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("Given the need to not flood resources added while running.")
+	push(10, 20)
+	if stats := m.ResourceStats(); stats[1].Jobs != 0 || !stats[1].WarmingUp {
+		t.Fatal("\tShould send no jobs to a resource that was just added", ballotX, stats)
+	}
+	t.Log("\tShould send no jobs to a resource that was just added", checkMark)
+
+	m.Resources[1].Added = time.Now().Add(-5 * time.Second)
+	push(20, 30)
+	if stats := m.ResourceStats(); stats[1].Jobs == 0 || stats[1].Jobs > stats[0].Jobs/2+1 {
+		t.Fatal("\tShould ramp up the share of a warming resource", ballotX, stats)
+	}
+	t.Log("\tShould ramp up the share of a warming resource", checkMark)
+
+	m.Resources[1].Added = time.Now().Add(-10 * time.Second)
+	push(30, 40)
+	if stats := m.ResourceStats(); stats[1].Jobs != stats[0].Jobs || stats[1].WarmingUp {
+		t.Fatal("\tShould give a warm resource its full share", ballotX, stats)
+	}
+	t.Log("\tShould give a warm resource its full share", checkMark)
+}
+
+func TestCapacity(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer gw.Close()
+	push := func(i int, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", fmt.Sprintf("/metrics/job/foo/instance/host%d", i), strings.NewReader(body))
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Log("Given the need to limit the jobs and series of resources.")
+	dir, err := ioutil.TempDir("", "middleman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "middleman.yml")
+	yml := "resources:\n  uris:\n    - \"http://localhost:9091\"\n    - uri: \"http://localhost:9092\"\n      max_jobs: 2\n      max_series: 10\n"
+	if err := ioutil.WriteFile(path, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := config.ReadConfig(path)
+	if err != nil {
+		t.Fatal("\tShould be able to read config", ballotX, err)
+	}
+	rs := staticResources(c)
+	if len(rs) != 2 || rs[0].MaxJobs != 0 || rs[1].MaxJobs != 2 || rs[1].MaxSeries != 10 {
+		t.Fatal("\tShould read plain uris and uris with limits", ballotX, rs)
+	}
+	t.Log("\tShould read plain uris and uris with limits", checkMark)
+
+	setup(nil, "least")
+	m.AddResource(resource.SvrResource{URI: gw.URL + "/a", MaxJobs: 2})
+	m.AddResource(resource.SvrResource{URI: gw.URL + "/b", MaxJobs: 1})
+	for i := 0; i < 3; i++ {
+		if w := push(i, "foo 1\n"); w.Code != http.StatusOK {
+			t.Fatal("\tShould place jobs while there is room", ballotX, w.Code)
+		}
+	}
+	w := push(3, "foo 1\n")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatal("\tShould turn new jobs away with a 503 when the pool is full", ballotX, w.Code, w.Header())
+	}
+	t.Log("\tShould turn new jobs away with a 503 when the pool is full", checkMark)
+	if w := push(0, "foo 2\n"); w.Code != http.StatusOK {
+		t.Fatal("\tShould keep taking pushes of placed jobs", ballotX, w.Code)
+	}
+	t.Log("\tShould keep taking pushes of placed jobs", checkMark)
+	for _, s := range m.ResourceStats() {
+		if !s.Full || s.MaxJobs == 0 {
+			t.Fatal("\tShould report the capacity of resources", ballotX, s)
+		}
+	}
+	t.Log("\tShould report the capacity of resources", checkMark)
+
+	setup(nil, "least")
+	m.AddResource(resource.SvrResource{URI: gw.URL + "/a", MaxSeries: 3})
+	if w := push(0, "foo 1\nbar 1\nbaz 1\n"); w.Code != http.StatusOK {
+		t.Fatal("\tShould place a job while there is room", ballotX, w.Code)
+	}
+	if w := push(1, "foo 1\n"); w.Code != http.StatusServiceUnavailable {
+		t.Fatal("\tShould count the series of pushes against the limit", ballotX, w.Code, m.ResourceStats())
+	}
+	t.Log("\tShould count the series of pushes against the limit", checkMark)
+	push(0, "foo 1\n")
+	if w := push(1, "foo 1\n"); w.Code != http.StatusOK || m.ResourceStats()[0].Series != 2 {
+		t.Fatal("\tShould free the series a job no longer pushes", ballotX, w.Code, m.ResourceStats())
+	}
+	t.Log("\tShould free the series a job no longer pushes", checkMark)
+
+	// every group of foo is one job, its series add up over its groups
+	setup(nil, "least")
+	if m.Identity, err = resource.NewIdentity("job", ""); err != nil {
+		t.Fatal(err)
+	}
+	m.AddResource(resource.SvrResource{URI: gw.URL + "/a", MaxSeries: 10})
+	push(0, "foo 1\nbar 1\n")
+	push(1, "foo 1\nbar 1\nbaz 1\n")
+	push(0, "foo 1\nbar 1\n")
+	if s := m.ResourceStats()[0].Series; s != 5 {
+		t.Fatal("\tShould count the series of every group of a job", ballotX, s)
+	}
+	t.Log("\tShould count the series of every group of a job", checkMark)
+	w = httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "/metrics/job/foo/instance/host1", nil)
+	if err != nil {
+		t.Fatal("\tShould be able to create a DELETE request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	if s := m.ResourceStats()[0].Series; s != 2 {
+		t.Fatal("\tShould free the series of deleted groups", ballotX, w.Code, s)
+	}
+	t.Log("\tShould free the series of deleted groups", checkMark)
+
+	setup(nil, "least")
+	m.AddResource(resource.SvrResource{URI: gw.URL + "/a", MaxSeries: 100})
+	for i := 0; i < 4; i++ {
+		push(i, "foo 1\nbar 1\n")
+	}
+	m.AddResource(resource.SvrResource{URI: gw.URL + "/b", MaxSeries: 3})
+	if plan := m.PlanRebalance(""); plan.After[gw.URL+"/b"] != 1 {
+		t.Fatal("\tShould rebalance within the series limit", ballotX, plan.After)
+	}
+	t.Log("\tShould rebalance within the series limit", checkMark)
+}
+
+func TestPriority(t *testing.T) {
+	var mux sync.Mutex
+	requests := map[string]int{}
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		mux.Lock()
+		requests[r.Method+" "+r.URL.Path[:2]]++
+		mux.Unlock()
+	}))
+	defer gw.Close()
+	cache, err := payload.NewCache(100, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup(nil, "least")
+	m.AddResource(resource.SvrResource{URI: gw.URL + "/a"})
+	m.AddResource(resource.SvrResource{URI: gw.URL + "/s", Priority: 1})
+	m.OnMigrate(handler.Replay(cache))
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{Payloads: cache})
+	push := func(from, to int) {
+		for i := from; i < to; i++ {
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest("PUT", fmt.Sprintf("/metrics/job/foo/instance/host%d", i), strings.NewReader("foo 1\n"))
+			if err != nil {
+				t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+			}
+			router.ServeHTTP(w, req)
+		}
+	}
+
+	t.Log("Given the need to keep standby resources for failover.")
+	push(0, 2)
+	if stats := m.ResourceStats(); stats[0].Jobs != 2 || stats[1].Jobs != 0 {
+		t.Fatal("\tShould send jobs to the best priority only", ballotX, stats)
+	}
+	t.Log("\tShould send jobs to the best priority only", checkMark)
+
+	mux.Lock()
+	requests = map[string]int{}
+	mux.Unlock()
+	m.SetHealthy(gw.URL+"/a", false)
+	if stats := m.ResourceStats(); stats[0].Jobs != 0 || stats[1].Jobs != 2 {
+		t.Fatal("\tShould fail the jobs of the primary over to the standby", ballotX, stats)
+	}
+	t.Log("\tShould fail the jobs of the primary over to the standby", checkMark)
+	done := false
+	for i := 0; i < 100 && !done; i++ {
+		time.Sleep(10 * time.Millisecond)
+		mux.Lock()
+		done = requests["PUT /s"] == 2
+		mux.Unlock()
+	}
+	if !done {
+		t.Fatal("\tShould replay the jobs failed over", ballotX, requests)
+	}
+	t.Log("\tShould replay the jobs failed over", checkMark)
+	push(2, 4)
+	if stats := m.ResourceStats(); stats[0].Jobs != 0 || stats[1].Jobs != 4 {
+		t.Fatal("\tShould fail new jobs over to the standby", ballotX, stats)
+	}
+	t.Log("\tShould fail new jobs over to the standby", checkMark)
+
+	mux.Lock()
+	requests = map[string]int{}
+	mux.Unlock()
+	m.SetHealthy(gw.URL+"/a", true)
+	if stats := m.ResourceStats(); stats[0].Jobs != 4 || stats[1].Jobs != 0 {
+		t.Fatal("\tShould move jobs back once the primary recovers", ballotX, stats)
+	}
+	t.Log("\tShould move jobs back once the primary recovers", checkMark)
+	done = false
+	for i := 0; i < 100 && !done; i++ {
+		time.Sleep(10 * time.Millisecond)
+		mux.Lock()
+		done = requests["PUT /a"] == 4 && requests["DELETE /s"] == 4
+		mux.Unlock()
+	}
+	if !done {
+		t.Fatal("\tShould replay the jobs moved back", ballotX, requests)
+	}
+	t.Log("\tShould replay the jobs moved back", checkMark)
+}
+
+func TestShutdown(t *testing.T) {
+	var mux sync.Mutex
+	pushed := 0
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		time.Sleep(200 * time.Millisecond)
+		mux.Lock()
+		pushed++
+		mux.Unlock()
+	}))
+	defer gw.Close()
+	setup([]string{gw.URL}, "least")
+	ready := &handler.Readiness{}
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{Readiness: ready})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: router}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+	base := "http://" + l.Addr().String()
+
+	t.Log("Given the need to shut down without losing in-flight pushes.")
+	resp, err := http.Get(base + "/-/ready")
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("\tShould not be ready before startup completes", ballotX, err)
+	}
+	resp.Body.Close()
+	ready.SetReady(true)
+	resp, err = http.Get(base + "/-/ready")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("\tShould be ready once started", ballotX, err)
+	}
+	resp.Body.Close()
+	t.Log("\tShould report readiness", checkMark)
+
+	status := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("PUT", base+"/metrics/job/foo", strings.NewReader("foo 1\n"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	shut := make(chan struct{})
+	go func() {
+		shutdown(server, ready, cancel, 300*time.Millisecond, 5*time.Second)
+		close(shut)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	resp, err = http.Get(base + "/-/ready")
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable || ctx.Err() != nil {
+		t.Fatal("\tShould keep serving while not ready for the ready delay", ballotX, err)
+	}
+	resp.Body.Close()
+	t.Log("\tShould keep serving while not ready for the ready delay", checkMark)
+	<-shut
+	if ready.Ready() || ctx.Err() == nil {
+		t.Fatal("\tShould stop being ready and stop background work", ballotX)
+	}
+	t.Log("\tShould stop being ready and stop background work", checkMark)
+	mux.Lock()
+	n := pushed
+	mux.Unlock()
+	if code := <-status; code != http.StatusOK || n != 1 {
+		t.Fatal("\tShould complete the in-flight push", ballotX, code, n)
+	}
+	t.Log("\tShould complete the in-flight push", checkMark)
+	if err := <-served; err != http.ErrServerClosed {
+		t.Fatal("\tShould stop serving", ballotX, err)
+	}
+	t.Log("\tShould stop serving", checkMark)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	setup([]string{"http://localhost:9091"}, "least")
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal("\tShould be able to create a GET request", ballotX, err)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Log("Given the need to probe middleman itself.")
+	if code := get("/-/healthy"); code != http.StatusOK {
+		t.Fatal("\tShould be healthy while serving", ballotX, code)
+	}
+	t.Log("\tShould be healthy while serving", checkMark)
+	if code := get("/-/ready"); code != http.StatusOK {
+		t.Fatal("\tShould be ready with a healthy resource", ballotX, code)
+	}
+	t.Log("\tShould be ready with a healthy resource", checkMark)
+	m.SetHealthy("http://localhost:9091", false)
+	if code := get("/-/ready"); code != http.StatusServiceUnavailable {
+		t.Fatal("\tShould not be ready without a healthy resource", ballotX, code)
+	}
+	t.Log("\tShould not be ready without a healthy resource", checkMark)
+	if code := get("/-/healthy"); code != http.StatusOK {
+		t.Fatal("\tShould stay healthy without a healthy resource", ballotX, code)
+	}
+	t.Log("\tShould stay healthy without a healthy resource", checkMark)
+}
+
+func TestAffinityUnhealthy(t *testing.T) {
+	setup([]string{"http://localhost:9091", "http://localhost:9092"}, "least")
+	var err error
+	if m.Affinity, err = resource.NewAffinity(resource.AffinityJob, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("Given the need to keep new jobs of affinity units off unavailable resources.")
+	first, err := m.FindResource("", "10.0.0.1", grouping.Key{Job: "foo", Labels: []grouping.Label{{Name: "instance", Value: "a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetHealthy(first.URL.String(), false)
+	next, err := m.FindResource("", "10.0.0.1", grouping.Key{Job: "foo", Labels: []grouping.Label{{Name: "instance", Value: "b"}}})
+	if err != nil || next.URL.String() == first.URL.String() {
+		t.Fatal("\tShould place the unit's new job on a healthy resource", ballotX, next.URL, err)
+	}
+	t.Log("\tShould place the unit's new job on a healthy resource", checkMark)
+	last, err := m.FindResource("", "10.0.0.1", grouping.Key{Job: "foo", Labels: []grouping.Label{{Name: "instance", Value: "c"}}})
+	if err != nil || last.URL.String() != next.URL.String() {
+		t.Fatal("\tShould keep the unit's later jobs together", ballotX, last.URL, err)
+	}
+	t.Log("\tShould keep the unit's later jobs together", checkMark)
+
+	m.SetHealthy(first.URL.String(), true)
+	m.Drain(next.URL.String(), true)
+	if _, err := m.FindResource("", "10.0.0.1", grouping.Key{Job: "foo", Labels: []grouping.Label{{Name: "instance", Value: "d"}}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, rs := range m.ResourceStats() {
+		if rs.Draining && rs.Jobs != 0 {
+			t.Fatal("\tShould place no job of the unit on a draining resource", ballotX, m.ResourceStats())
+		}
+	}
+	t.Log("\tShould place no job of the unit on a draining resource", checkMark)
+}
+
+func TestReplayJobIdentity(t *testing.T) {
+	var mux sync.Mutex
+	requests := []string{}
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(b))
+		mux.Unlock()
+	}))
+	defer gw.Close()
+	cache, err := payload.NewCache(100, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup([]string{gw.URL + "/a", gw.URL + "/b"}, "least")
+	if m.Identity, err = resource.NewIdentity(resource.IdentityJob, ""); err != nil {
+		t.Fatal(err)
+	}
+	m.OnMigrate(handler.Replay(cache))
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{Payloads: cache})
+	for _, g := range []string{"a", "b"} {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/metrics/job/foo/instance/"+g, strings.NewReader("m_"+g+" 1\n"))
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		router.ServeHTTP(w, req)
+	}
+	from := m.JobStats()[0].Resource
+	to := gw.URL + "/a"
+	if from == to {
+		to = gw.URL + "/b"
+	}
+	from, to = strings.TrimPrefix(from, gw.URL), strings.TrimPrefix(to, gw.URL)
+	mux.Lock()
+	requests = []string{}
+	mux.Unlock()
+
+	t.Log("Given the need to move every group of jobs pushing many groups.")
+	if err := m.Drain(gw.URL+from, true); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"PUT " + to + "/metrics/job/foo/instance/a m_a 1\n": true,
+		"PUT " + to + "/metrics/job/foo/instance/b m_b 1\n": true,
+		"DELETE " + from + "/metrics/job/foo/instance/a ":   true,
+		"DELETE " + from + "/metrics/job/foo/instance/b ":   true,
+	}
+	done := false
+	for i := 0; i < 100 && !done; i++ {
+		time.Sleep(10 * time.Millisecond)
+		mux.Lock()
+		done = len(requests) == len(want)
+		for _, r := range requests {
+			done = done && want[r]
+		}
+		mux.Unlock()
+	}
+	if !done {
+		t.Fatal("\tShould replay and delete every group of the moved job", ballotX, requests)
+	}
+	t.Log("\tShould replay and delete every group of the moved job", checkMark)
+}
+
+func TestNoHealthyResource(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer gw.Close()
+	dir, err := ioutil.TempDir("", "middleman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spooler, err := spool.New(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spooler.Close()
+	setup([]string{gw.URL}, "least")
+	m.SetHealthy(gw.URL, false)
+	t.Log("Given the need to not drop pushes nobody can take.")
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/metrics/job/foo", strings.NewReader("foo 1\n"))
+	if err != nil {
+		t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatal("\tShould answer 503 with Retry-After when no resource is healthy", ballotX, w.Code, w.Header())
+	}
+	t.Log("\tShould answer 503 with Retry-After when no resource is healthy", checkMark)
+
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{Spool: spooler})
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("PUT", "/metrics/job/foo", strings.NewReader("foo 1\n"))
+	if err != nil {
+		t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted || len(m.JobStats()) != 1 || m.JobStats()[0].Resource != gw.URL {
+		t.Fatal("\tShould spool the push with 202 when no resource is healthy", ballotX, w.Code, m.JobStats())
+	}
+	if d := spooler.Depth()[gw.URL]; d.Records != 1 {
+		t.Fatal("\tShould spool the push with 202 when no resource is healthy", ballotX, d)
+	}
+	t.Log("\tShould spool the push with 202 when no resource is healthy", checkMark)
+}
+
+// proxyV2 builds a PROXY protocol v2 header of command cmd for family fam
+// with addresses src and dst
+func proxyV2(cmd byte, fam byte, src, dst net.IP, srcPort, dstPort uint16) []byte {
+	addrs := append(append([]byte{}, src...), dst...)
+	addrs = append(addrs, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	hdr := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20|cmd, fam, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		header  []byte
+		remote  string
+		data    string
+		fails   bool
+	}{
+		{"v1 TCP4", "127.0.0.1", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 4242 9091\r\n"), "1.2.3.4:4242", "hello", false},
+		{"v1 TCP6", "127.0.0.1", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4242 9091\r\n"), "[2001:db8::1]:4242", "hello", false},
+		{"v1 UNKNOWN", "127.0.0.1", []byte("PROXY UNKNOWN\r\n"), "127.0.0.1", "hello", false},
+		{"v2 IPv4", "127.0.0.1", proxyV2(1, 0x11, net.ParseIP("1.2.3.4").To4(), net.ParseIP("5.6.7.8").To4(), 4242, 9091),
+			"1.2.3.4:4242", "hello", false},
+		{"v2 IPv6", "127.0.0.1", proxyV2(1, 0x21, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 4242, 9091),
+			"[2001:db8::1]:4242", "hello", false},
+		{"v2 LOCAL", "127.0.0.1", proxyV2(0, 0x11, net.ParseIP("1.2.3.4").To4(), net.ParseIP("5.6.7.8").To4(), 4242, 9091),
+			"127.0.0.1", "hello", false},
+		{"malformed", "127.0.0.1", []byte("PROXY TCP4 not-an-ip 5.6.7.8 4242 9091\r\n"), "127.0.0.1", "", true},
+		{"untrusted", "10.0.0.0/8", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 4242 9091\r\n"), "127.0.0.1",
+			"PROXY TCP4 1.2.3.4 5.6.7.8 4242 9091\r\nhello", false},
+	}
+	t.Log("Given the need to take client addresses from PROXY protocol headers.")
+	for _, tt := range tests {
+		clients, err := clientid.NewResolver([]string{tt.trusted})
+		if err != nil {
+			t.Fatal("\tShould be able to create a resolver", ballotX, err)
+		}
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := clientid.NewProxyListener(inner, clients)
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(append(tt.header, "hello"...))
+		conn.(*net.TCPConn).CloseWrite()
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(c)
+		remote := c.RemoteAddr().String()
+		c.Close()
+		conn.Close()
+		l.Close()
+		if tt.fails {
+			if err == nil {
+				t.Fatal("\tShould refuse malformed headers", ballotX, tt.name, string(data))
+			}
+			continue
+		}
+		if err != nil || string(data) != tt.data {
+			t.Fatal("\tShould pass the data after the header on", ballotX, tt.name, string(data), err)
+		}
+		if remote != tt.remote && clientid.Host(remote) != tt.remote {
+			t.Fatal("\tShould take the remote address from trusted headers only", ballotX, tt.name, remote)
+		}
+	}
+	t.Log("\tShould take the remote address from trusted headers only", checkMark)
+	t.Log("\tShould refuse malformed headers", checkMark)
+}
+
+func TestReloadResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "middleman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "middleman.yml")
+	write := func(maxJobs int) {
+		conf := fmt.Sprintf(`middleman:
+  algorithm: least
+resources:
+  uris:
+    - http://localhost:9091
+    - uri: http://localhost:9092
+      max_jobs: %d
+`, maxJobs)
+		if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(10)
+	c, err := config.ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr, err := CreateManager(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sr := range staticResources(c) {
+		if err := mgr.AddResource(sr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, host := range []string{"10.0.0.1", "10.0.0.2"} {
+		if _, err := mgr.FindResource("", host, grouping.Key{Job: "batch"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes, moves := 0, 0
+	mgr.OnResourceChange(func() { changes++ })
+	mgr.OnMigrate(func(ms []resource.Migration) { moves += len(ms) })
+
+	t.Log("Given the need to reload the config without disturbing resources.")
+	if err := reloadResources(path, mgr); err != nil {
+		t.Fatal("\tShould be able to reload the config", ballotX, err)
+	}
+	if changes != 0 || moves != 0 || len(mgr.JobStats()) != 2 {
+		t.Fatal("\tShould leave resources of an unchanged config alone", ballotX, changes, moves)
+	}
+	t.Log("\tShould leave resources of an unchanged config alone", checkMark)
+
+	write(20)
+	if err := reloadResources(path, mgr); err != nil {
+		t.Fatal("\tShould be able to reload the config", ballotX, err)
+	}
+	limits := 0
+	for _, r := range mgr.ResourceList() {
+		if r.URL.String() == "http://localhost:9092" {
+			limits = r.MaxJobs
+		}
+	}
+	if changes != 0 || moves != 0 || limits != 20 {
+		t.Fatal("\tShould change limits in place", ballotX, changes, moves, limits)
+	}
+	t.Log("\tShould change limits in place", checkMark)
+}
+
+func TestAdminToken(t *testing.T) {
+	setup([]string{"http://localhost:9091"}, "least")
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{AdminToken: "secret"})
+
+	t.Log("Given the need to guard the admin API without tenants.")
+	for _, token := range []string{"", "wrong"} {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/admin/rebalance?dry_run=true", nil)
+		if err != nil {
+			t.Fatal("\tShould be able to create a POST request", ballotX, err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Fatal("\tShould refuse admin requests without the admin token", ballotX, token, w.Code)
+		}
+	}
+	t.Log("\tShould refuse admin requests without the admin token", checkMark)
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/admin/rebalance?dry_run=true", nil)
+	if err != nil {
+		t.Fatal("\tShould be able to create a POST request", ballotX, err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatal("\tShould take admin requests with the admin token", ballotX, w.Code)
+	}
+	t.Log("\tShould take admin requests with the admin token", checkMark)
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/status", nil)
+	if err != nil {
+		t.Fatal("\tShould be able to create a GET request", ballotX, err)
+	}
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatal("\tShould keep /status open without tenants", ballotX, w.Code)
+	}
+	t.Log("\tShould keep /status open without tenants", checkMark)
+}
+
+func TestRecoverCleanup(t *testing.T) {
+	var mux sync.Mutex
+	down := map[string]bool{}
+	requests := []string{}
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		mux.Lock()
+		defer mux.Unlock()
+		prefix := r.URL.Path[:2]
+		if down[prefix] {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+	}))
+	defer gw.Close()
+	dir, err := ioutil.TempDir("", "middleman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spooler, err := spool.New(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spooler.Close()
+	setup([]string{gw.URL + "/a", gw.URL + "/b"}, "least")
+	m.OnStale(handler.DeleteStale)
+	m.OnMigrate(handler.Respool(spooler, nil))
+	router = httprouter.New()
+	handler.SetupRoutes(router, m, "", handler.Options{Spool: spooler})
+	push := func() int {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/metrics/job/foo", strings.NewReader("foo 1\n"))
+		if err != nil {
+			t.Fatal("\tShould be able to create a PUT request", ballotX, err)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	seen := func(request string) bool {
+		for i := 0; i < 100; i++ {
+			mux.Lock()
+			for _, r := range requests {
+				if r == request {
+					mux.Unlock()
+					return true
+				}
+			}
+			mux.Unlock()
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	t.Log("Given the need to clean up after a resource that failed over.")
+	push()
+	from := m.JobStats()[0].Resource
+	prefix := strings.TrimPrefix(from, gw.URL)
+	to := gw.URL + "/a"
+	if from == to {
+		to = gw.URL + "/b"
+	}
+	mux.Lock()
+	down[prefix] = true
+	mux.Unlock()
+	if code := push(); code != http.StatusAccepted || spooler.Depth()[from].Records != 1 {
+		t.Fatal("\tShould spool the push for the resource that is down", ballotX, code, spooler.Depth())
+	}
+	m.SetHealthy(from, false)
+	if spooler.Depth()[from].Records != 0 || !seen("PUT "+strings.TrimPrefix(to, gw.URL)+"/metrics/job/foo") {
+		t.Fatal("\tShould deliver the spooled push to the resource the job failed over to", ballotX, spooler.Depth())
+	}
+	t.Log("\tShould deliver the spooled push to the resource the job failed over to", checkMark)
+
+	mux.Lock()
+	down[prefix] = false
+	mux.Unlock()
+	m.SetHealthy(from, true)
+	if !seen("DELETE " + prefix + "/metrics/job/foo") {
+		t.Fatal("\tShould delete the group from the recovered resource", ballotX, requests)
+	}
+	t.Log("\tShould delete the group from the recovered resource", checkMark)
+}
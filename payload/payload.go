@@ -0,0 +1,202 @@
+package payload
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// spillSuffix ends the names of the files payloads are spilled to
+const spillSuffix = ".payload"
+
+// Entry is a push as it was forwarded
+type Entry struct {
+	Method string
+	Header http.Header
+	Body   []byte
+}
+
+func (e *Entry) size() int64 {
+	return int64(len(e.Body))
+}
+
+// item is a cached entry, entry is nil once it has been spilled to disk
+type item struct {
+	key   string
+	entry *Entry
+}
+
+// Cache keeps the last push of every job so it can be replayed. It holds at
+// most maxEntries pushes and maxMemory body bytes in memory. When memory is
+// full the least recently pushed entries are spilled to dir, or dropped when
+// there is no dir.
+type Cache struct {
+	maxEntries int
+	maxMemory  int64
+	dir        string
+	memory     int64
+	lru        *list.List
+	items      map[string]*list.Element
+	mux        sync.Mutex
+}
+
+// NewCache returns an empty cache, spilling to dir unless it is empty.
+// Payloads spilled by an earlier run are removed.
+func NewCache(maxEntries int, maxMemory int64, dir string) (*Cache, error) {
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf("Payload cache needs room for at least one entry")
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		stale, err := filepath.Glob(filepath.Join(dir, "*"+spillSuffix))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range stale {
+			os.Remove(f)
+		}
+	}
+	return &Cache{maxEntries: maxEntries,
+		maxMemory: maxMemory,
+		dir:       dir,
+		lru:       list.New(),
+		items:     map[string]*list.Element{}}, nil
+}
+
+func (c *Cache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+spillSuffix)
+}
+
+// remove forgets el. Called with mux held.
+func (c *Cache) remove(el *list.Element) {
+	it := el.Value.(*item)
+	if it.entry != nil {
+		c.memory -= it.entry.size()
+	} else {
+		os.Remove(c.path(it.key))
+	}
+	c.lru.Remove(el)
+	delete(c.items, it.key)
+}
+
+// spill writes it to disk and drops it from memory. Called with mux held.
+func (c *Cache) spill(it *item) error {
+	f, err := os.Create(c.path(it.key))
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(it.entry); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	c.memory -= it.entry.size()
+	it.entry = nil
+	return nil
+}
+
+// evict brings the cache back within its bounds. Called with mux held.
+func (c *Cache) evict() {
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	for el := c.lru.Back(); el != nil && c.maxMemory > 0 && c.memory > c.maxMemory; {
+		prev := el.Prev()
+		it := el.Value.(*item)
+		if it.entry == nil {
+			el = prev
+			continue
+		}
+		if c.dir == "" {
+			c.remove(el)
+		} else if err := c.spill(it); err != nil {
+			log.Errorf("Failed to spill payload of %v: %v", it.key, err)
+			c.remove(el)
+		}
+		el = prev
+	}
+}
+
+// Put records e as the last push of key
+func (c *Cache) Put(key string, e Entry) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.items[key] = c.lru.PushFront(&item{key: key, entry: &e})
+	c.memory += e.size()
+	c.evict()
+}
+
+// Get returns the last push of key
+func (c *Cache) Get(key string) (Entry, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return Entry{}, false
+	}
+	it := el.Value.(*item)
+	if it.entry != nil {
+		return *it.entry, true
+	}
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		log.Errorf("Failed to read spilled payload of %v: %v", key, err)
+		return Entry{}, false
+	}
+	defer f.Close()
+	var e Entry
+	if err := gob.NewDecoder(f).Decode(&e); err != nil {
+		log.Errorf("Failed to read spilled payload of %v: %v", key, err)
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// Delete forgets the last push of key
+func (c *Cache) Delete(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Len returns the number of entries in memory and spilled to disk
+func (c *Cache) Len() (int, int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	spilled := 0
+	for _, el := range c.items {
+		if el.Value.(*item).entry == nil {
+			spilled++
+		}
+	}
+	return len(c.items) - spilled, spilled
+}
+
+// Header returns the headers of a push worth forwarding and replaying
+func Header(h http.Header) http.Header {
+	kept := http.Header{}
+	for k, v := range h {
+		if strings.HasPrefix(k, "Content-") && k != "Content-Length" {
+			kept[k] = v
+		}
+	}
+	return kept
+}
@@ -0,0 +1,59 @@
+package resource
+
+import (
+	"fmt"
+	"github.com/bass3m/middleman/grouping"
+)
+
+// Affinity levels, jobs of the same affinity unit are placed on the same
+// resource
+const (
+	// AffinityNone places every job on its own
+	AffinityNone = ""
+	// AffinityGroup keeps the pushes of a grouping key together, whatever
+	// the client
+	AffinityGroup = "group"
+	// AffinityJob keeps every group of a job together
+	AffinityJob = "job"
+	// AffinityLabel keeps the groups sharing the value of a label together
+	AffinityLabel = "label"
+)
+
+// Affinity returns the affinity unit of a grouping key, "" when the job should
+// be placed on its own
+type Affinity func(k grouping.Key) string
+
+// unit is a set of jobs placed together
+type unit struct {
+	resource *Resource
+	jobs     int
+}
+
+// NewAffinity returns the Affinity for level. label is only used by the label
+// level, groups without that label are placed on their own.
+func NewAffinity(level string, label string) (Affinity, error) {
+	switch level {
+	case AffinityNone:
+		return nil, nil
+	case AffinityGroup:
+		return func(k grouping.Key) string {
+			return k.String()
+		}, nil
+	case AffinityJob:
+		return func(k grouping.Key) string {
+			return fmt.Sprintf("{job=%q}", k.Job)
+		}, nil
+	case AffinityLabel:
+		if label == "" {
+			return nil, fmt.Errorf("Affinity level %v requires a label", level)
+		}
+		return func(k grouping.Key) string {
+			v := k.Label(label)
+			if v == "" {
+				return ""
+			}
+			return fmt.Sprintf("{%s=%q}", label, v)
+		}, nil
+	}
+	return nil, fmt.Errorf("Unrecognized affinity level %v", level)
+}
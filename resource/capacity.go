@@ -0,0 +1,87 @@
+package resource
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bass3m/middleman/grouping"
+)
+
+// ErrPoolFull is returned for a new job when every resource it could go to
+// already has its maximum number of jobs or series
+var ErrPoolFull = errors.New("No resource with free capacity in pool")
+
+// full reports whether r is at its maximum number of jobs or series and
+// takes no new jobs. Called with mux held.
+func (r *Resource) full() bool {
+	return !r.takes(len(r.Jobs), r.Series, 1, 0)
+}
+
+// takes reports whether r, holding jobs jobs with series series, can take n
+// more jobs with s series: it is not full and stays within its limits.
+func (r *Resource) takes(jobs int, series int, n int, s int) bool {
+	return (r.MaxJobs == 0 || (jobs < r.MaxJobs && jobs+n <= r.MaxJobs)) &&
+		(r.MaxSeries == 0 || (series < r.MaxSeries && series+s <= r.MaxSeries))
+}
+
+// RecordSeries records that the last push of the job of client host of
+// tenant for grouping key k holds n series
+func (m *Manager) RecordSeries(tenant string, host string, k grouping.Key, n int) error {
+	key := m.jobKey(tenant, host, k)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	j, ok := m.jobs[key]
+	if !ok {
+		return fmt.Errorf("Job: Remote %v group %v not found", host, k)
+	}
+	j.setSeries(k.String(), n)
+	return nil
+}
+
+// setSeries records that group g of j holds n series, on j and its resource.
+// Called with mux held.
+func (j *Job) setSeries(g string, n int) {
+	if j.series == nil {
+		j.series = map[string]int{}
+	}
+	d := n - j.series[g]
+	j.series[g] = n
+	j.Series += d
+	j.resource.Series += d
+}
+
+// LimitsSeries reports whether any resource has a maximum number of series,
+// only then do pushes need their series counted
+func (m *Manager) LimitsSeries() bool {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	for _, r := range m.Resources {
+		if r.MaxSeries > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLimits changes the maximum number of jobs and series of the resource at
+// url. Jobs it already has stay, jobs of lower priority resources move to it
+// when it has room again.
+func (m *Manager) SetLimits(url string, maxJobs int, maxSeries int) error {
+	m.mux.Lock()
+	var moves []Migration
+	found := false
+	for _, r := range m.Resources {
+		if r.URL.String() != url {
+			continue
+		}
+		found = true
+		r.MaxJobs, r.MaxSeries = maxJobs, maxSeries
+		moves = m.failBack(r.Pool)
+		break
+	}
+	m.mux.Unlock()
+	if !found {
+		return fmt.Errorf("No resource found with url %v", url)
+	}
+	m.migrated(moves)
+	return nil
+}
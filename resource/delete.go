@@ -0,0 +1,61 @@
+package resource
+
+import (
+	"github.com/bass3m/middleman/grouping"
+)
+
+// Deletion is a DELETE of a group to send to a resource
+type Deletion struct {
+	Resource Resource
+	// Key is the group to delete, its Path is the path to send the DELETE to
+	Key grouping.Key
+	// Jobs are the jobs the group is deleted from
+	Jobs []JobKey
+}
+
+// DeleteMatching forgets every group of tenant matching sel, whichever client
+// pushed it, and returns the deletions to send. Jobs are forgotten with their
+// last group. Resources hold one copy of a group however many clients push
+// it, so every group is deleted once per resource.
+func (m *Manager) DeleteMatching(tenant string, sel grouping.Key) []Deletion {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	deletions := []Deletion{}
+	seen := map[string]int{}
+	for _, j := range m.jobs {
+		if j.tenant != tenant {
+			continue
+		}
+		for _, k := range j.Keys() {
+			if !k.Matches(sel) {
+				continue
+			}
+			if j.forget(k) {
+				m.unassign(j)
+			}
+			id := j.resource.URL.String() + k.String()
+			if i, ok := seen[id]; ok {
+				deletions[i].Jobs = append(deletions[i].Jobs, j.key)
+				continue
+			}
+			seen[id] = len(deletions)
+			deletions = append(deletions, Deletion{Resource: *j.resource, Key: k, Jobs: []JobKey{j.key}})
+		}
+	}
+	return deletions
+}
+
+// PoolResources returns the resources of the pool a push of client host of
+// tenant with grouping key k would go to
+func (m *Manager) PoolResources(tenant string, host string, k grouping.Key) []Resource {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	pool := m.route(tenant, host, k)
+	rs := []Resource{}
+	for _, r := range m.Resources {
+		if r.Pool == pool {
+			rs = append(rs, *r)
+		}
+	}
+	return rs
+}
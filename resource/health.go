@@ -0,0 +1,123 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthPath is polled on resources to check their health
+const HealthPath = "/-/healthy"
+
+// ErrNoHealthyResource is returned for a new job when no resource of its pool
+// is healthy and not draining
+var ErrNoHealthyResource = errors.New("No healthy resource available in pool")
+
+// SetHealthy records whether the resource at url is healthy. Unhealthy
+// resources get no new jobs and their jobs fail over to the other resources
+// of their pool, lower tiers included, when there are any. Recovered
+// resources get back the jobs that failed over to lower tiers, and the
+// groups that stayed away are to be deleted from them.
+func (m *Manager) SetHealthy(url string, healthy bool) error {
+	changed, moves, deletions, err := m.setHealthy(url, healthy)
+	if changed {
+		m.resourcesChanged()
+	}
+	m.migrated(moves)
+	m.staled(deletions)
+	return err
+}
+
+// OnStale registers f to be called with the groups a recovered resource
+// still holds though they failed over to another resource while it was
+// down. f is called without the manager locked.
+func (m *Manager) OnStale(f func([]Deletion)) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.onStale = append(m.onStale, f)
+}
+
+func (m *Manager) staled(deletions []Deletion) {
+	if len(deletions) == 0 {
+		return
+	}
+	m.mux.RLock()
+	hooks := m.onStale
+	m.mux.RUnlock()
+	for _, f := range hooks {
+		f(deletions)
+	}
+}
+
+func (m *Manager) setHealthy(url string, healthy bool) (bool, []Migration, []Deletion, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, r := range m.Resources {
+		if r.URL.String() != url {
+			continue
+		}
+		changed := r.Unhealthy == healthy
+		if changed {
+			log.Infof("Resource %v healthy: %v", url, healthy)
+		}
+		r.Unhealthy = !healthy
+		switch {
+		case changed && healthy:
+			moves := m.failBack(r.Pool)
+			return changed, moves, m.stale(r), nil
+		case changed:
+			return changed, m.failOver(r), nil, nil
+		}
+		return changed, nil, nil, nil
+	}
+	return false, nil, nil, fmt.Errorf("No resource found with url %v", url)
+}
+
+// checkResource reports whether r answers its health endpoint within timeout
+func checkResource(ctx context.Context, r Resource, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", r.URL.String()+HealthPath, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := r.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Debugf("Health check of %v failed: %v", r.URL, err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// CheckHealth polls every resource each interval until ctx is done, marking
+// the resources that don't answer within timeout unhealthy
+func (m *Manager) CheckHealth(ctx context.Context, interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, r := range m.ResourceList() {
+			wg.Add(1)
+			go func(r Resource) {
+				defer wg.Done()
+				healthy := checkResource(ctx, r, timeout)
+				if ctx.Err() != nil {
+					return
+				}
+				// the resource may have been removed meanwhile
+				m.SetHealthy(r.URL.String(), healthy)
+			}(r)
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package resource
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bass3m/middleman/grouping"
+	"text/template"
+)
+
+// Identity modes, they decide which pushes are treated as the same job
+const (
+	// IdentityHostGroup keys jobs on the client host and the grouping key
+	IdentityHostGroup = "host_group"
+	// IdentityGroup keys jobs on the grouping key only
+	IdentityGroup = "group"
+	// IdentityJob keys jobs on the job name only
+	IdentityJob = "job"
+	// IdentityTemplate keys jobs on a template over the grouping key labels
+	IdentityTemplate = "template"
+)
+
+// Identity returns the job key of a push by host with grouping key k
+type Identity func(host string, k grouping.Key) JobKey
+
+func hostGroupIdentity(host string, k grouping.Key) JobKey {
+	return JobKey(host + "/" + k.String())
+}
+
+// NewIdentity returns the Identity for mode. tmpl is only used by the template
+// mode, it is executed with the job and every label of the grouping key, for
+// example `{{.job}}/{{.env}}`. Labels missing from a push are empty.
+func NewIdentity(mode string, tmpl string) (Identity, error) {
+	switch mode {
+	case "", IdentityHostGroup:
+		return hostGroupIdentity, nil
+	case IdentityGroup:
+		return func(host string, k grouping.Key) JobKey {
+			return JobKey(k.String())
+		}, nil
+	case IdentityJob:
+		return func(host string, k grouping.Key) JobKey {
+			return JobKey(fmt.Sprintf("{job=%q}", k.Job))
+		}, nil
+	case IdentityTemplate:
+		if tmpl == "" {
+			return nil, fmt.Errorf("Identity mode %v requires a template", mode)
+		}
+		t, err := template.New("identity").Option("missingkey=zero").Parse(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse identity template: %v", err)
+		}
+		return func(host string, k grouping.Key) JobKey {
+			labels := map[string]string{"job": k.Job}
+			for _, l := range k.Labels {
+				labels[l.Name] = l.Value
+			}
+			var b bytes.Buffer
+			if err := t.Execute(&b, labels); err != nil {
+				// fall back to the grouping key rather than lumping jobs together
+				return JobKey(k.String())
+			}
+			return JobKey(b.String())
+		}, nil
+	}
+	return nil, fmt.Errorf("Unrecognized identity mode %v", mode)
+}
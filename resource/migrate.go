@@ -0,0 +1,98 @@
+package resource
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bass3m/middleman/grouping"
+)
+
+// Migration is a job moved from one resource to another
+type Migration struct {
+	Job JobKey
+	Key grouping.Key
+	// Keys are every group of the job, all of them move
+	Keys []grouping.Key
+	From Resource
+	To   Resource
+	// DeleteOld is set when From is still up and its copy of the group
+	// should be deleted once the group is on To
+	DeleteOld bool
+}
+
+// OnMigrate registers f to be called with the jobs moved whenever jobs move
+// to another resource. f is called without the manager locked.
+func (m *Manager) OnMigrate(f func([]Migration)) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.onMigrate = append(m.onMigrate, f)
+}
+
+func (m *Manager) migrated(moves []Migration) {
+	if len(moves) == 0 {
+		return
+	}
+	m.mux.RLock()
+	hooks := m.onMigrate
+	m.mux.RUnlock()
+	for _, f := range hooks {
+		f(moves)
+	}
+}
+
+// migrate moves jobs to other resources of their pool, their resource must
+// no longer take new jobs. Jobs that can't be placed are forgotten, they are
+// placed again on their next push. deleteOld is set on the migrations.
+// Called with mux held.
+func (m *Manager) migrate(jobs []*Job, deleteOld bool) []Migration {
+	// unassign every job first so affinity units are placed anew
+	for _, j := range jobs {
+		m.unassign(j)
+	}
+	moves := []Migration{}
+	for _, j := range jobs {
+		from := j.resource
+		r, err := m.place(j)
+		if err != nil {
+			log.Warnf("Forgetting job %v of %v: %v", j.key, from.URL, err)
+			continue
+		}
+		m.assign(j, r)
+		moves = append(moves, Migration{Job: j.key, Key: j.Key, Keys: j.Keys(), From: *from, To: *r,
+			DeleteOld: deleteOld})
+	}
+	return moves
+}
+
+// Drain stops giving new jobs to the resource at url and moves its jobs to
+// the other resources of its pool. Undraining gives it new jobs again, and
+// back the jobs of lower tiers.
+func (m *Manager) Drain(url string, draining bool) error {
+	moves, err := m.drain(url, draining)
+	if err != nil {
+		return err
+	}
+	m.resourcesChanged()
+	m.migrated(moves)
+	return nil
+}
+
+func (m *Manager) drain(url string, draining bool) ([]Migration, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, r := range m.Resources {
+		if r.URL.String() != url {
+			continue
+		}
+		r.Draining = draining
+		if !draining {
+			return m.failBack(r.Pool), nil
+		}
+		jobs := make([]*Job, 0, len(r.Jobs))
+		for _, j := range r.Jobs {
+			jobs = append(jobs, j)
+		}
+		log.Infof("Draining %d jobs of resource %v", len(jobs), url)
+		return m.migrate(jobs, true), nil
+	}
+	return nil, fmt.Errorf("No resource found with url %v", url)
+}
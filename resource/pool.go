@@ -0,0 +1,125 @@
+package resource
+
+import (
+	"fmt"
+	"github.com/bass3m/middleman/grouping"
+	"net"
+	"regexp"
+)
+
+// DefaultPool receives the resources and jobs not given another pool
+const DefaultPool = "default"
+
+// Pool is a named set of resources balanced by their own Balancer
+type Pool struct {
+	Name     string
+	Balancer Balancer
+}
+
+// Rule sends the jobs it matches to a pool. A job matches when every set
+// condition matches, regexps are anchored like in Prometheus.
+type Rule struct {
+	Pool   string
+	Job    *regexp.Regexp
+	Labels map[string]*regexp.Regexp
+	CIDRs  []*net.IPNet
+}
+
+func anchored(re string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + re + ")$")
+}
+
+// NewRule compiles a rule, empty conditions match every job
+func NewRule(pool string, job string, labels map[string]string, cidrs []string) (*Rule, error) {
+	r := &Rule{Pool: pool, Labels: map[string]*regexp.Regexp{}}
+	var err error
+	if job != "" {
+		if r.Job, err = anchored(job); err != nil {
+			return nil, fmt.Errorf("Invalid job regexp %q for pool %v: %v", job, pool, err)
+		}
+	}
+	for name, re := range labels {
+		if r.Labels[name], err = anchored(re); err != nil {
+			return nil, fmt.Errorf("Invalid regexp %q for label %v of pool %v: %v", re, name, pool, err)
+		}
+	}
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %q for pool %v: %v", c, pool, err)
+		}
+		r.CIDRs = append(r.CIDRs, n)
+	}
+	return r, nil
+}
+
+// Matches reports whether the push of client host with grouping key k matches
+func (r *Rule) Matches(host string, k grouping.Key) bool {
+	if r.Job != nil && !r.Job.MatchString(k.Job) {
+		return false
+	}
+	for name, re := range r.Labels {
+		if !re.MatchString(k.Label(name)) {
+			return false
+		}
+	}
+	if len(r.CIDRs) == 0 {
+		return true
+	}
+	ip := net.ParseIP(host)
+	for _, n := range r.CIDRs {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewBalancer returns the Balancer for algo
+func NewBalancer(algo string) (Balancer, error) {
+	switch algo {
+	case "least":
+		return &LeastManager{}, nil
+	}
+	return nil, fmt.Errorf("Unrecognized balancer option %v", algo)
+}
+
+// AddPool adds a pool balanced with algo
+func (m *Manager) AddPool(name string, algo string) error {
+	b, err := NewBalancer(algo)
+	if err != nil {
+		return err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.Pools[name]; ok {
+		return fmt.Errorf("Pool %v already exists", name)
+	}
+	m.Pools[name] = &Pool{Name: name, Balancer: b}
+	return nil
+}
+
+// AddRule appends a rule, rules are tried in the order they were added
+func (m *Manager) AddRule(r *Rule) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.Pools[r.Pool]; !ok {
+		return fmt.Errorf("Rule for unknown pool %v", r.Pool)
+	}
+	m.Rules = append(m.Rules, r)
+	return nil
+}
+
+// route returns the pool of the push of client host of tenant with grouping
+// key k, the tenant's pool if it has one. Called with mux held.
+func (m *Manager) route(tenant string, host string, k grouping.Key) string {
+	if t, ok := m.tenants[tenant]; ok && t.pool != "" {
+		return t.pool
+	}
+	for _, r := range m.Rules {
+		if r.Matches(host, k) {
+			return r.Pool
+		}
+	}
+	return DefaultPool
+}
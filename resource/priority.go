@@ -0,0 +1,111 @@
+package resource
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/bass3m/middleman/grouping"
+)
+
+// preferred returns the resources of rs with the best priority, the lowest
+// Priority value. Lower tiers only get jobs when no better one can.
+func preferred(rs []*Resource) []*Resource {
+	best := []*Resource{}
+	for _, r := range rs {
+		if len(best) > 0 && r.Priority > best[0].Priority {
+			continue
+		}
+		if len(best) > 0 && r.Priority < best[0].Priority {
+			best = best[:0]
+		}
+		best = append(best, r)
+	}
+	return best
+}
+
+// failBack moves the jobs of pool placed on a lower tier than the best one
+// taking new jobs back to it, once higher tier resources recover. Called
+// with mux held.
+func (m *Manager) failBack(pool string) []Migration {
+	best, ok := 0, false
+	for _, r := range m.Resources {
+		if eligible(r, pool) && !r.full() && (!ok || r.Priority < best) {
+			best, ok = r.Priority, true
+		}
+	}
+	if !ok {
+		return nil
+	}
+	moves := []Migration{}
+	for _, r := range m.Resources {
+		if r.Pool != pool || r.Priority <= best {
+			continue
+		}
+		moves = append(moves, m.relocate(r, true, func(to *Resource) bool {
+			return to.Priority < r.Priority
+		})...)
+	}
+	if len(moves) > 0 {
+		log.Infof("Moved %d jobs of pool %v back to priority %d", len(moves), pool, best)
+	}
+	return moves
+}
+
+// failOver moves the jobs of r, which went down, to the other resources of
+// its pool, lower tiers included. Jobs with nowhere to go stay on r. The
+// groups that left are remembered to delete them from r once it is back.
+// Called with mux held.
+func (m *Manager) failOver(r *Resource) []Migration {
+	moves := m.relocate(r, false, func(to *Resource) bool { return true })
+	if len(moves) > 0 {
+		log.Infof("Failed %d jobs of resource %v over", len(moves), r.URL)
+	}
+	if r.left == nil {
+		r.left = map[string]grouping.Key{}
+	}
+	for _, mv := range moves {
+		for _, k := range mv.Keys {
+			r.left[k.String()] = k
+		}
+	}
+	return moves
+}
+
+// stale returns the deletions of the groups that failed over while r was
+// down and are not back on r, and forgets them. Called with mux held.
+func (m *Manager) stale(r *Resource) []Deletion {
+	for _, j := range r.Jobs {
+		for g := range j.groups {
+			delete(r.left, g)
+		}
+	}
+	deletions := make([]Deletion, 0, len(r.left))
+	for _, k := range r.left {
+		deletions = append(deletions, Deletion{Resource: *r, Key: k})
+	}
+	r.left = nil
+	return deletions
+}
+
+// relocate places the jobs of r anew, affinity units as a whole, and keeps
+// the new placements accepted by better. Jobs left without a better place
+// stay on r. deleteOld is set on the migrations. Called with mux held.
+func (m *Manager) relocate(r *Resource, deleteOld bool, better func(to *Resource) bool) []Migration {
+	moves := []Migration{}
+	for _, it := range itemsOf(r) {
+		// unassign the whole unit so it is placed anew
+		for _, j := range it.jobs {
+			m.unassign(j)
+		}
+		to, err := m.place(it.jobs[0])
+		if err != nil || to == r || !better(to) {
+			to = r
+		}
+		for _, j := range it.jobs {
+			m.assign(j, to)
+			if to != r {
+				moves = append(moves, Migration{Job: j.key, Key: j.Key, Keys: j.Keys(), From: *r, To: *to,
+					DeleteOld: deleteOld})
+			}
+		}
+	}
+	return moves
+}
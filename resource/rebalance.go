@@ -0,0 +1,254 @@
+package resource
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// PlannedMove is a job a rebalance moves
+type PlannedMove struct {
+	Job         JobKey `json:"job"`
+	GroupingKey string `json:"grouping_key"`
+	Pool        string `json:"pool"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+}
+
+// Plan is what a rebalance does, the jobs of every resource before and after
+type Plan struct {
+	Moves  []PlannedMove  `json:"moves"`
+	Before map[string]int `json:"before"`
+	After  map[string]int `json:"after"`
+}
+
+// item is a set of jobs that move together, an affinity unit or a single job
+type item struct {
+	jobs []*Job
+}
+
+// series returns the series of the jobs of it
+func (it *item) series() int {
+	n := 0
+	for _, j := range it.jobs {
+		n += j.Series
+	}
+	return n
+}
+
+// eligible reports whether r takes part in the balance of pool
+func eligible(r *Resource, pool string) bool {
+	return r.Pool == pool && !r.Unhealthy && !r.Draining
+}
+
+// itemsOf groups the jobs of r into the items that move together
+func itemsOf(r *Resource) []*item {
+	units := map[string]*item{}
+	items := []*item{}
+	for _, j := range r.Jobs {
+		if j.unit == "" {
+			items = append(items, &item{jobs: []*Job{j}})
+			continue
+		}
+		it, ok := units[j.unit]
+		if !ok {
+			it = &item{}
+			units[j.unit] = it
+			items = append(items, it)
+		}
+		it.jobs = append(it.jobs, j)
+	}
+	sort.Slice(items, func(a, b int) bool { return items[a].jobs[0].key < items[b].jobs[0].key })
+	return items
+}
+
+type itemMove struct {
+	item *item
+	to   *Resource
+}
+
+// planPool plans the moves evening out the jobs of the healthy resources of
+// pool. Every move goes from the busiest to the idlest resource and takes
+// the item bringing them closest, until they differ by at most one job or no
+// item fits within the limits of the idlest, so few jobs move. Called with
+// mux held.
+func (m *Manager) planPool(pool string) []itemMove {
+	rs := []*Resource{}
+	for _, r := range m.Resources {
+		if eligible(r, pool) {
+			rs = append(rs, r)
+		}
+	}
+	// lower tiers only take the jobs the best one can't
+	rs = preferred(rs)
+	if len(rs) < 2 {
+		return nil
+	}
+	load := map[*Resource]int{}
+	series := map[*Resource]int{}
+	items := map[*Resource][]*item{}
+	for _, r := range rs {
+		load[r] = len(r.Jobs)
+		series[r] = r.Series
+		items[r] = itemsOf(r)
+	}
+	moves := []itemMove{}
+	for {
+		sort.Slice(rs, func(a, b int) bool {
+			if load[rs[a]] != load[rs[b]] {
+				return load[rs[a]] < load[rs[b]]
+			}
+			return rs[a].URL.String() < rs[b].URL.String()
+		})
+		from, to := rs[len(rs)-1], rs[0]
+		diff := load[from] - load[to]
+		if diff <= 1 {
+			return moves
+		}
+		// moving n jobs helps as long as n < diff, n = diff/2 helps most
+		best := -1
+		for i, it := range items[from] {
+			n := len(it.jobs)
+			if n >= diff || !to.takes(load[to], series[to], n, it.series()) {
+				continue
+			}
+			if best < 0 || abs(2*n-diff) < abs(2*len(items[from][best].jobs)-diff) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return moves
+		}
+		it := items[from][best]
+		items[from] = append(items[from][:best], items[from][best+1:]...)
+		load[from] -= len(it.jobs)
+		load[to] += len(it.jobs)
+		series[from] -= it.series()
+		series[to] += it.series()
+		moves = append(moves, itemMove{item: it, to: to})
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// plan plans the rebalance of pool, of every pool when it is empty. Called
+// with mux held.
+func (m *Manager) plan(pool string) ([]itemMove, Plan) {
+	moves := []itemMove{}
+	for name := range m.Pools {
+		if pool == "" || name == pool {
+			moves = append(moves, m.planPool(name)...)
+		}
+	}
+	p := Plan{Moves: []PlannedMove{}, Before: map[string]int{}, After: map[string]int{}}
+	for _, r := range m.Resources {
+		if pool == "" || r.Pool == pool {
+			p.Before[r.URL.String()] = len(r.Jobs)
+			p.After[r.URL.String()] = len(r.Jobs)
+		}
+	}
+	for _, mv := range moves {
+		for _, j := range mv.item.jobs {
+			from, to := j.resource.URL.String(), mv.to.URL.String()
+			p.Moves = append(p.Moves, PlannedMove{Job: j.key, GroupingKey: j.Key.String(), Pool: j.pool,
+				From: from, To: to})
+			p.After[from]--
+			p.After[to]++
+		}
+	}
+	return moves, p
+}
+
+// PlanRebalance returns what Rebalance would do without doing it
+func (m *Manager) PlanRebalance(pool string) Plan {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	_, p := m.plan(pool)
+	return p
+}
+
+// Rebalance moves jobs so the healthy resources of pool, of every pool when
+// it is empty, have as many jobs as possible, moving as few jobs as
+// possible. Affinity units move as a whole.
+func (m *Manager) Rebalance(pool string) Plan {
+	m.mux.Lock()
+	moves, p := m.plan(pool)
+	migrations := []Migration{}
+	for _, mv := range moves {
+		from := *mv.item.jobs[0].resource
+		// unassign the whole unit first so it is recorded on its new resource
+		for _, j := range mv.item.jobs {
+			m.unassign(j)
+		}
+		for _, j := range mv.item.jobs {
+			m.assign(j, mv.to)
+			migrations = append(migrations, Migration{Job: j.key, Key: j.Key, Keys: j.Keys(), From: from, To: *mv.to,
+				DeleteOld: true})
+		}
+	}
+	m.mux.Unlock()
+	if len(migrations) > 0 {
+		log.Infof("Rebalanced %d jobs", len(migrations))
+	}
+	m.migrated(migrations)
+	return p
+}
+
+// Skew returns how uneven the jobs of the healthy resources are, the largest
+// over the pools of the difference between the busiest and idlest resource
+// relative to the mean
+func (m *Manager) Skew() float64 {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	skew := 0.0
+	for pool := range m.Pools {
+		rs := []*Resource{}
+		for _, r := range m.Resources {
+			if eligible(r, pool) {
+				rs = append(rs, r)
+			}
+		}
+		n, total, min, max := 0, 0, -1, 0
+		for _, r := range preferred(rs) {
+			jobs := len(r.Jobs)
+			n, total = n+1, total+jobs
+			if min < 0 || jobs < min {
+				min = jobs
+			}
+			if jobs > max {
+				max = jobs
+			}
+		}
+		if n < 2 || total == 0 {
+			continue
+		}
+		if s := float64(max-min) / (float64(total) / float64(n)); s > skew {
+			skew = s
+		}
+	}
+	return skew
+}
+
+// AutoRebalance checks the skew every interval until ctx is done and
+// rebalances every pool when it exceeds threshold
+func (m *Manager) AutoRebalance(ctx context.Context, interval time.Duration, threshold float64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if skew := m.Skew(); skew > threshold {
+			log.Infof("Job skew %.2f exceeds %.2f, rebalancing", skew, threshold)
+			m.Rebalance("")
+		}
+	}
+}
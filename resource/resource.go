@@ -3,105 +3,449 @@ package resource
 import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/bass3m/middleman/grouping"
 	"net/http"
 	"net/url"
-	"strings"
+	"sort"
 	"sync"
+	"time"
 )
 
+// JobKey is the identity of a job, used to index the manager's jobs. How it
+// is derived from a push depends on the manager's Identity.
+type JobKey string
+
 type Job struct {
-	addr string
-	URL  *url.URL
+	addr        string
+	Key         grouping.Key
+	FirstSeen   time.Time
+	LastPush    time.Time
+	Pushes      int64
+	Bytes       int64
+	LastStatus  int
+	LastLatency time.Duration
+	// Series is the number of series of the last push of every group of the
+	// job
+	Series   int
+	key      JobKey
+	tenant   string
+	pool     string
+	unit     string
+	resource *Resource
+	// groups holds every group pushed for the job by its string, more than
+	// one with identities that don't tell groups apart
+	groups map[string]grouping.Key
+	// series holds the series of the last push of every group by its string
+	series map[string]int
+}
+
+// Keys returns every group pushed for the job, sorted
+func (j *Job) Keys() []grouping.Key {
+	names := make([]string, 0, len(j.groups))
+	for n := range j.groups {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	keys := make([]grouping.Key, 0, len(names))
+	for _, n := range names {
+		keys = append(keys, j.groups[n])
+	}
+	return keys
+}
+
+// forget forgets group k of the job and its series, and reports whether it
+// was the last one. Called with mux held.
+func (j *Job) forget(k grouping.Key) bool {
+	g := k.String()
+	j.setSeries(g, 0)
+	delete(j.series, g)
+	delete(j.groups, g)
+	return len(j.groups) == 0
 }
 
+// JobStats is a point in time copy of a job's push statistics
+type JobStats struct {
+	Tenant             string    `json:"tenant,omitempty"`
+	Client             string    `json:"client"`
+	GroupingKey        string    `json:"grouping_key"`
+	Pool               string    `json:"pool"`
+	Resource           string    `json:"resource"`
+	FirstSeen          time.Time `json:"first_seen"`
+	LastPush           time.Time `json:"last_push"`
+	Pushes             int64     `json:"pushes"`
+	Bytes              int64     `json:"bytes"`
+	LastStatus         int       `json:"last_status"`
+	LastLatencySeconds float64   `json:"last_latency_seconds"`
+}
+
+// SvrResource describes a resource to add to the manager, the admin API
+// takes it as JSON
 type SvrResource struct {
-	URI string
-	ID  string
+	URI  string `json:"uri"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Pool string `json:"pool"`
+	// Source is set by whoever adds the resource
+	Source string `json:"-"`
+	// MaxJobs and MaxSeries bound what the resource takes, 0 means no limit
+	MaxJobs   int `json:"max_jobs"`
+	MaxSeries int `json:"max_series"`
+	// Priority is the tier of the resource, 0 is the best
+	Priority int `json:"priority"`
 }
 
+// Where resources come from
+const (
+	SourceConfig = "config"
+	SourceDocker = "docker"
+	SourceAPI    = "api"
+)
+
 type Resource struct {
 	// XXX want to add an id so it's easier to delete
 	Client   *http.Client
 	URL      *url.URL
-	Jobs     []Job
+	Jobs     map[JobKey]*Job
 	JobsSent int
 	ID       string
+	// Name is the container name of docker resources
+	Name string
+	Pool string
+	// Source tells where the resource comes from, config, docker or api
+	Source string
+	// Unhealthy resources get no new jobs, their jobs fail over
+	Unhealthy bool
+	// Draining resources get no new jobs, their jobs moved away
+	Draining bool
+	// Added is when the resource was added while slow start was enabled, it
+	// warms up from then on. Zero for the resources we start with.
+	Added time.Time
+	// Series counts the series of the last push of every job
+	Series int
+	// Full resources, at MaxJobs jobs or MaxSeries series, get no new jobs.
+	// 0 means no limit.
+	MaxJobs   int
+	MaxSeries int
+	// Priority is the tier of the resource, lower values are better. Jobs
+	// go to the best tier with a healthy resource that isn't full.
+	Priority int
+	// left holds the groups that failed over while the resource was down,
+	// its copies of them are deleted once it recovers
+	left map[string]grouping.Key
 }
 
+// Balancer picks the resource a new job should be assigned to. The manager
+// takes care of recording the assignment.
 type Balancer interface {
-	Balance([]*Resource, Job) (Resource, error)
+	Balance([]*Resource, *Job) (*Resource, error)
 }
 
+// Manager tracks resources and the jobs assigned to them. Resources are
+// split into pools, Rules decide the pool of a job unless its tenant has its
+// own. jobs indexes every job by its key so lookups don't depend on the
+// number of jobs, units holds the placement of every affinity unit with jobs.
+// Every Manager method is safe for concurrent use, mux guards Resources,
+// Pools, Rules and the jobs and statistics of every resource.
 type Manager struct {
-	Balancer  Balancer
+	Identity Identity
+	Affinity Affinity
+	// WarmUp is how long a new resource takes to get its full share of new
+	// jobs, 0 disables slow start
+	WarmUp    time.Duration
+	Pools     map[string]*Pool
+	Rules     []*Rule
 	Resources []*Resource
-	mux       sync.Mutex
+	onChange  []func()
+	onMigrate []func([]Migration)
+	onStale   []func([]Deletion)
+	jobs      map[JobKey]*Job
+	units     map[string]*unit
+	tenants   map[string]*tenantState
+	mux       sync.RWMutex
 }
 
-func (m *Manager) Balance(job Job) (Resource, error) {
-	return m.Balancer.Balance(m.Resources, job)
+// place finds the resource of a new job, the resource of its affinity unit if
+// the unit is already placed on a resource taking new jobs. Called with mux
+// held.
+func (m *Manager) place(job *Job) (*Resource, error) {
+	if m.Affinity != nil {
+		if u := m.Affinity(job.Key); u != "" {
+			// units don't span pools or tenants
+			job.unit = job.tenant + "/" + job.pool + "/" + u
+		}
+	}
+	if u, ok := m.units[job.unit]; ok && job.unit != "" && !u.resource.Unhealthy && !u.resource.Draining {
+		if u.resource.full() {
+			return nil, ErrPoolFull
+		}
+		return u.resource, nil
+	}
+	return m.Balance(job)
 }
 
-type LeastManager struct{}
-
-func (r *Resource) JobExists(ra string, u *url.URL) bool {
-	i, _ := r.FindJobIdx(ra, u)
-	return i > -1
+// assign records job on r. Called with mux held.
+func (m *Manager) assign(job *Job, r *Resource) {
+	job.resource = r
+	r.Jobs[job.key] = job
+	r.Series += job.Series
+	m.jobs[job.key] = job
+	if t, ok := m.tenants[job.tenant]; ok {
+		t.jobs++
+	}
+	if job.unit == "" {
+		return
+	}
+	u, ok := m.units[job.unit]
+	if !ok {
+		u = &unit{resource: r}
+		m.units[job.unit] = u
+	}
+	// a unit whose resource takes no new jobs carries on with r
+	u.resource = r
+	u.jobs++
 }
 
-func (r *Resource) FindJobIdx(ra string, u *url.URL) (int, error) {
-	for i, job := range r.Jobs {
-		if strings.Compare(job.addr, ra) == 0 && strings.Compare(job.URL.String(), u.String()) == 0 {
-			r.JobsSent++
-			log.Debugf("Found Job %v at index %d JobsSent %d", job, i, r.JobsSent)
-			return i, nil
+// unassign forgets job. Called with mux held.
+func (m *Manager) unassign(job *Job) {
+	delete(job.resource.Jobs, job.key)
+	job.resource.Series -= job.Series
+	delete(m.jobs, job.key)
+	if t, ok := m.tenants[job.tenant]; ok {
+		t.jobs--
+	}
+	if u, ok := m.units[job.unit]; ok {
+		if u.jobs--; u.jobs <= 0 {
+			delete(m.units, job.unit)
 		}
 	}
-	return -1, fmt.Errorf("Job: Remote %v URL %v not found", ra, u.String())
 }
 
-func (m Manager) JobExists(ra string, u *url.URL) bool {
+// Balance picks a resource for job among the healthy resources of its pool
+func (m *Manager) Balance(job *Job) (*Resource, error) {
+	return m.balance(job, func(r *Resource) bool { return !r.Unhealthy && !r.Draining })
+}
+
+// balance picks a resource for job among the eligible resources of its pool.
+// Called with mux held.
+func (m *Manager) balance(job *Job, eligible func(*Resource) bool) (*Resource, error) {
+	p, ok := m.Pools[job.pool]
+	if !ok {
+		return nil, fmt.Errorf("No pool %v", job.pool)
+	}
+	candidates := []*Resource{}
 	for _, r := range m.Resources {
-		if r.JobExists(ra, u) == true {
-			return true
+		if r.Pool == job.pool && eligible(r) {
+			candidates = append(candidates, r)
 		}
 	}
-	return false
+	if len(candidates) == 0 {
+		return nil, ErrNoHealthyResource
+	}
+	free := []*Resource{}
+	for _, r := range candidates {
+		if !r.full() {
+			free = append(free, r)
+		}
+	}
+	if len(free) == 0 {
+		return nil, ErrPoolFull
+	}
+	return p.Balancer.Balance(m.warm(preferred(free)), job)
 }
 
-func (m *Manager) FindResource(remoteAddr string, u *url.URL) (Resource, error) {
-	host := strings.Split(remoteAddr, ":")[0]
+type LeastManager struct{}
+
+// JobExists reports whether the push of client host of tenant with grouping
+// key k is a known job
+func (m *Manager) JobExists(tenant string, host string, k grouping.Key) bool {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	_, ok := m.jobs[m.jobKey(tenant, host, k)]
+	return ok
+}
+
+// FindResource returns the resource the push of client host of tenant with
+// grouping key k goes to, assigning the job to a resource if it is new
+func (m *Manager) FindResource(tenant string, host string, k grouping.Key) (Resource, error) {
+	key := m.jobKey(tenant, host, k)
+	m.mux.RLock()
+	if j, ok := m.jobs[key]; ok {
+		r := *j.resource
+		m.mux.RUnlock()
+		log.Debugf("Found existing resource %v for host %v", r.URL, host)
+		return r, nil
+	}
+	m.mux.RUnlock()
+	return m.findResource(tenant, host, k, m.place)
+}
+
+// FindSpoolResource is FindResource for pushes that can be spooled: when no
+// resource of the pool of a new job is healthy, the job goes to one of the
+// unhealthy ones and its pushes wait in the spool until it is back.
+func (m *Manager) FindSpoolResource(tenant string, host string, k grouping.Key) (Resource, error) {
+	return m.findResource(tenant, host, k, func(job *Job) (*Resource, error) {
+		r, err := m.place(job)
+		if err != ErrNoHealthyResource {
+			return r, err
+		}
+		return m.balance(job, func(r *Resource) bool { return !r.Draining })
+	})
+}
+
+// findResource returns the resource of the job of client host of tenant with
+// grouping key k, assigning it to the resource place picks when it is new
+func (m *Manager) findResource(tenant string, host string, k grouping.Key,
+	place func(*Job) (*Resource, error)) (Resource, error) {
+	key := m.jobKey(tenant, host, k)
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	for _, r := range m.Resources {
-		// remoteAddr is host:port
-		if r.JobExists(host, u) == true {
-			log.Debugf("Found existing resource %v for host %v", r, host)
-			return *r, nil
-		}
+	// the job may have been assigned while we weren't holding the lock
+	if j, ok := m.jobs[key]; ok {
+		return *j.resource, nil
 	}
 	// otherwise find a resource to handle job
-	job := Job{addr: host, URL: u}
-	if r, err := m.Balance(job); err == nil {
-		log.Debugf("Found new resource %v for new job: %v", r, job)
-		return r, nil
+	if t, ok := m.tenants[tenant]; ok && t.maxJobs > 0 && t.jobs >= t.maxJobs {
+		return Resource{}, ErrTenantQuota
+	}
+	job := &Job{addr: host, Key: k, FirstSeen: time.Now(), key: key, tenant: tenant,
+		groups: map[string]grouping.Key{k.String(): k},
+		pool:   m.route(tenant, host, k)}
+	r, err := place(job)
+	if err == ErrPoolFull || err == ErrNoHealthyResource {
+		return Resource{}, err
+	}
+	if err != nil {
+		return Resource{}, fmt.Errorf("No resource found for Job %v: %v", key, err)
+	}
+	m.assign(job, r)
+	log.Debugf("Found new resource %v for new job: %v", r.URL, key)
+	return *r, nil
+}
+
+// RecordPush updates the statistics of the job pushed by client host of tenant
+// for grouping key k. status is the upstream HTTP status, 0 if the resource
+// could not be reached.
+func (m *Manager) RecordPush(tenant string, host string, k grouping.Key, bytes int64, status int, latency time.Duration) error {
+	key := m.jobKey(tenant, host, k)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	j, ok := m.jobs[key]
+	if !ok {
+		return fmt.Errorf("Job: Remote %v group %v not found", host, k)
+	}
+	// with identities that ignore the host, the job moves with its client
+	j.addr = host
+	j.groups[k.String()] = k
+	j.LastPush = time.Now()
+	j.Pushes++
+	j.Bytes += bytes
+	j.LastStatus = status
+	j.LastLatency = latency
+	j.resource.JobsSent++
+	return nil
+}
+
+// JobStats returns the statistics of every job known to the manager
+func (m *Manager) JobStats() []JobStats {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	stats := make([]JobStats, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		stats = append(stats, JobStats{Tenant: j.tenant,
+			Client:             j.addr,
+			GroupingKey:        j.Key.String(),
+			Pool:               j.pool,
+			Resource:           j.resource.URL.String(),
+			FirstSeen:          j.FirstSeen,
+			LastPush:           j.LastPush,
+			Pushes:             j.Pushes,
+			Bytes:              j.Bytes,
+			LastStatus:         j.LastStatus,
+			LastLatencySeconds: j.LastLatency.Seconds()})
+	}
+	return stats
+}
+
+// ResourceStats is a point in time summary of a resource
+type ResourceStats struct {
+	URL       string `json:"url"`
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Pool      string `json:"pool"`
+	Source    string `json:"source,omitempty"`
+	Jobs      int    `json:"jobs"`
+	JobsSent  int    `json:"jobs_sent"`
+	Healthy   bool   `json:"healthy"`
+	Draining  bool   `json:"draining"`
+	WarmingUp bool   `json:"warming_up"`
+	Series    int    `json:"series"`
+	MaxJobs   int    `json:"max_jobs,omitempty"`
+	MaxSeries int    `json:"max_series,omitempty"`
+	Full      bool   `json:"full"`
+	Priority  int    `json:"priority"`
+}
+
+// ResourceStats returns a summary of every resource known to the manager
+func (m *Manager) ResourceStats() []ResourceStats {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	stats := []ResourceStats{}
+	now := time.Now()
+	for _, r := range m.Resources {
+		stats = append(stats, ResourceStats{URL: r.URL.String(),
+			ID:        r.ID,
+			Name:      r.Name,
+			Pool:      r.Pool,
+			Source:    r.Source,
+			Jobs:      len(r.Jobs),
+			JobsSent:  r.JobsSent,
+			Healthy:   !r.Unhealthy,
+			Draining:  r.Draining,
+			WarmingUp: m.warmingUp(r, now),
+			Series:    r.Series,
+			MaxJobs:   r.MaxJobs,
+			MaxSeries: r.MaxSeries,
+			Full:      r.full(),
+			Priority:  r.Priority})
+	}
+	return stats
+}
+
+// ResourceList returns a copy of every resource known to the manager
+func (m *Manager) ResourceList() []Resource {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	rs := make([]Resource, 0, len(m.Resources))
+	for _, r := range m.Resources {
+		rs = append(rs, *r)
+	}
+	return rs
+}
+
+// Label is how the resource is labelled outside middleman, its ID if it has
+// one, otherwise its URL
+func (r Resource) Label() string {
+	if r.ID != "" {
+		return r.ID
 	}
-	return Resource{}, fmt.Errorf("No resource found for Job %v", job)
+	return r.URL.String()
 }
 
 func (j Job) Print() {
-	fmt.Printf("\tJob: Addr: %v URL: %v\n", j.addr, j.URL.String())
+	fmt.Printf("\tJob: Addr: %v Group: %v\n", j.addr, j.Key)
 }
 func (r Resource) Print() {
-	for i, j := range r.Jobs {
-		fmt.Printf("\tResource: URL %v\n", r.URL.String())
-		fmt.Printf("\tJobs at %d:\n", i)
-		fmt.Printf("\t===============\n")
+	fmt.Printf("\tResource: URL %v\n", r.URL.String())
+	fmt.Printf("\tJobs:\n")
+	fmt.Printf("\t===============\n")
+	for _, j := range r.Jobs {
 		j.Print()
 	}
 
 }
-func (m Manager) Print() {
+func (m *Manager) Print() {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
 	for i, r := range m.Resources {
 		fmt.Printf("Resource at %d:\n", i)
 		fmt.Printf("===============\n")
@@ -109,55 +453,167 @@ func (m Manager) Print() {
 	}
 }
 
-func (m *Manager) DeleteJob(remoteAddr string, u *url.URL) (Resource, error) {
-	rs := m.Resources
-	host := strings.Split(remoteAddr, ":")[0]
-	for i, r := range rs {
-		// remoteAddr is host:port
-		if j, err := r.FindJobIdx(host, u); err == nil {
-			log.Debugf("Deleting found existing resource %v:%d at idx %d for host %v\n", r, i, j, host)
-			jobs := append(r.Jobs[:j], r.Jobs[j+1:]...)
-			m.Resources[i].Jobs = jobs
-			m.Print()
-			return *r, nil
-		}
+// DeleteJob forgets group k of the job of client host of tenant and returns
+// the resource to delete it from. The job is forgotten with its last group.
+func (m *Manager) DeleteJob(tenant string, host string, k grouping.Key) (Resource, error) {
+	key := m.jobKey(tenant, host, k)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	j, ok := m.jobs[key]
+	if !ok {
+		return Resource{}, fmt.Errorf("No resource found for host %v group %v", host, k)
+	}
+	r := j.resource
+	log.Debugf("Deleting group %v of job %v from resource %v for host %v", k, key, r.URL, host)
+	if j.forget(k) {
+		m.unassign(j)
+	}
+	return *r, nil
+}
+
+// OnResourceChange registers f to be called whenever a resource is added,
+// removed or changes health. f is called without the manager locked.
+func (m *Manager) OnResourceChange(f func()) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.onChange = append(m.onChange, f)
+}
+
+func (m *Manager) resourcesChanged() {
+	m.mux.RLock()
+	hooks := m.onChange
+	m.mux.RUnlock()
+	for _, f := range hooks {
+		f()
 	}
-	return Resource{}, fmt.Errorf("No resource found for remoteAddr %v url %v", remoteAddr, u.String())
 }
 
-func (m *Manager) AddResource(strURL string, id string) {
-	u, err := url.Parse(strURL)
+// AddResource adds a resource, to the default pool unless sr names one
+func (m *Manager) AddResource(sr SvrResource) error {
+	moves, err := m.addResource(sr)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	m.resourcesChanged()
+	m.migrated(moves)
+	return nil
+}
+
+// addResource adds the resource and moves the jobs of lower tiers to it
+func (m *Manager) addResource(sr SvrResource) ([]Migration, error) {
+	u, err := url.Parse(sr.URI)
+	if err != nil {
+		return nil, err
+	}
+	pool := sr.Pool
+	if pool == "" {
+		pool = DefaultPool
 	}
 
 	r := &Resource{Client: &http.Client{},
-		URL:      u,
-		ID:       id,
-		Jobs:     []Job{},
-		JobsSent: 0}
+		URL:       u,
+		ID:        sr.ID,
+		Name:      sr.Name,
+		Pool:      pool,
+		Source:    sr.Source,
+		MaxJobs:   sr.MaxJobs,
+		MaxSeries: sr.MaxSeries,
+		Priority:  sr.Priority,
+		Jobs:      map[JobKey]*Job{},
+		JobsSent:  0}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.Pools[pool]; !ok {
+		return nil, fmt.Errorf("Resource %v for unknown pool %v", sr.URI, pool)
+	}
+	for _, er := range m.Resources {
+		if er.URL.String() == u.String() {
+			return nil, fmt.Errorf("Resource %v already exists", sr.URI)
+		}
+	}
+	if m.WarmUp > 0 {
+		r.Added = time.Now()
+	}
 	rs := append(m.Resources, r)
 	m.Resources = rs
-	log.Debugf("Added resource: %v Now %v", r, m.Resources)
+	log.Debugf("Added resource: %v Now %d resources", r.URL, len(m.Resources))
+	return m.failBack(pool), nil
+}
+
+// RemoveResource removes the resource with the given id. Its jobs move to
+// the remaining resources of its pool, or are forgotten when there are none
+// and balanced again on their next push.
+func (m *Manager) RemoveResource(id string) error {
+	if id == "" {
+		return fmt.Errorf("No resource id")
+	}
+	moves, err := m.removeResource(func(r *Resource) bool { return r.ID == id })
+	if err != nil {
+		return fmt.Errorf("No resource found with id %v", id)
+	}
+	m.resourcesChanged()
+	m.migrated(moves)
+	return nil
 }
 
-func CreateBalancer(uris map[string]string, algo string) *Manager {
-	var m *Manager
-	switch algo {
-	case "least":
-		m = &Manager{Balancer: &LeastManager{}}
-		break
-	default:
-		log.Fatalf("Unrecognized balancer option %v", algo)
+// RemoveResourceURL removes the resource at url like RemoveResource
+func (m *Manager) RemoveResourceURL(url string) error {
+	moves, err := m.removeResource(func(r *Resource) bool { return r.URL.String() == url })
+	if err != nil {
+		return fmt.Errorf("No resource found with url %v", url)
 	}
+	m.resourcesChanged()
+	m.migrated(moves)
+	return nil
+}
 
-	for u, i := range uris {
-		m.AddResource(u, i)
+func (m *Manager) removeResource(match func(*Resource) bool) ([]Migration, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for i, r := range m.Resources {
+		if !match(r) {
+			continue
+		}
+		rs := make([]*Resource, 0, len(m.Resources)-1)
+		rs = append(rs, m.Resources[:i]...)
+		m.Resources = append(rs, m.Resources[i+1:]...)
+		jobs := make([]*Job, 0, len(r.Jobs))
+		for _, j := range r.Jobs {
+			jobs = append(jobs, j)
+		}
+		log.Debugf("Removed resource: %v", r.URL)
+		return m.migrate(jobs, false), nil
+	}
+	return nil, fmt.Errorf("No resource found")
+}
+
+// JobKey returns the key of the job a push of client host of tenant with
+// grouping key k belongs to
+func (m *Manager) JobKey(tenant string, host string, k grouping.Key) JobKey {
+	return m.jobKey(tenant, host, k)
+}
+
+// CreateBalancer creates a manager whose default pool is balanced with algo.
+// Other pools must be added before resources that belong to them.
+func CreateBalancer(resources []SvrResource, algo string) *Manager {
+	m := &Manager{Identity: hostGroupIdentity,
+		Pools:   map[string]*Pool{},
+		jobs:    map[JobKey]*Job{},
+		units:   map[string]*unit{},
+		tenants: map[string]*tenantState{}}
+	if err := m.AddPool(DefaultPool, algo); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, sr := range resources {
+		if err := m.AddResource(sr); err != nil {
+			log.Fatal(err)
+		}
 	}
 	return m
 }
 
-func (LeastManager) Balance(resources []*Resource, j Job) (Resource, error) {
+func (LeastManager) Balance(resources []*Resource, j *Job) (*Resource, error) {
 	// initilize min to len of first resource's jobs
 	minIdx := 0
 	min := len(resources[minIdx].Jobs)
@@ -168,10 +624,6 @@ func (LeastManager) Balance(resources []*Resource, j Job) (Resource, error) {
 			min = len(r.Jobs)
 		}
 	}
-	// add job to resource
-	jobs := append(resources[minIdx].Jobs, j)
-	resources[minIdx].Jobs = jobs
-	resources[minIdx].JobsSent++
-	log.Debugf("Least used resource: %v", resources[minIdx])
-	return *resources[minIdx], nil
+	log.Debugf("Least used resource: %v", resources[minIdx].URL)
+	return resources[minIdx], nil
 }
@@ -0,0 +1,42 @@
+package resource
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bass3m/middleman/grouping"
+)
+
+// ErrTenantQuota is returned for a new job of a tenant that already has its
+// maximum number of jobs
+var ErrTenantQuota = errors.New("Tenant job quota exceeded")
+
+// tenantState is what the manager knows about a tenant, jobs counts its jobs
+type tenantState struct {
+	pool    string
+	maxJobs int
+	jobs    int
+}
+
+// AddTenant registers a tenant whose jobs go to pool, or are routed by the
+// rules when pool is empty. maxJobs bounds its jobs, 0 means no limit.
+func (m *Manager) AddTenant(name string, pool string, maxJobs int) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.tenants[name]; ok {
+		return fmt.Errorf("Tenant %v already exists", name)
+	}
+	if _, ok := m.Pools[pool]; pool != "" && !ok {
+		return fmt.Errorf("Tenant %v for unknown pool %v", name, pool)
+	}
+	m.tenants[name] = &tenantState{pool: pool, maxJobs: maxJobs}
+	return nil
+}
+
+// jobKey scopes the identity of a push to its tenant so tenants never share
+// jobs
+func (m *Manager) jobKey(tenant string, host string, k grouping.Key) JobKey {
+	if tenant == "" {
+		return m.Identity(host, k)
+	}
+	return JobKey(tenant + "|" + string(m.Identity(host, k)))
+}
@@ -0,0 +1,42 @@
+package resource
+
+import (
+	"time"
+)
+
+// warmingUp reports whether r is still within the manager's warm-up window
+func (m *Manager) warmingUp(r *Resource, now time.Time) bool {
+	return m.WarmUp > 0 && now.Sub(r.Added) < m.WarmUp
+}
+
+// warm drops from rs the resources still warming up that already have their
+// share of jobs. A warming resource's share grows linearly with its age, from
+// nothing when added to the mean of the warm resources once WarmUp is over.
+// The balancer only sees what is left, so slow start works with any
+// balancer. Called with mux held.
+func (m *Manager) warm(rs []*Resource) []*Resource {
+	if m.WarmUp <= 0 {
+		return rs
+	}
+	now := time.Now()
+	warm, warmJobs := 0, 0
+	for _, r := range rs {
+		if !m.warmingUp(r, now) {
+			warm++
+			warmJobs += len(r.Jobs)
+		}
+	}
+	// no warm resource to compare with, nothing to protect
+	if warm == 0 || warm == len(rs) {
+		return rs
+	}
+	mean := float64(warmJobs) / float64(warm)
+	kept := make([]*Resource, 0, len(rs))
+	for _, r := range rs {
+		ramp := float64(now.Sub(r.Added)) / float64(m.WarmUp)
+		if !m.warmingUp(r, now) || float64(len(r.Jobs)+1) <= mean*ramp {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,127 @@
+package resource
+
+import (
+	"fmt"
+	"github.com/bass3m/middleman/grouping"
+	"sort"
+)
+
+// Change is a change of the resources to try out
+type Change struct {
+	Add []SvrResource `json:"add"`
+	// Remove holds the URLs or ids of the resources to remove
+	Remove []string `json:"remove"`
+	// Rebalance rebalances the pools once the resources have changed
+	Rebalance bool `json:"rebalance"`
+}
+
+// WhatIf is the outcome of a Change: the jobs that would move, those that
+// would be left without a resource and the jobs of every resource before and
+// after
+type WhatIf struct {
+	Moves    []PlannedMove  `json:"moves"`
+	Unplaced []string       `json:"unplaced"`
+	Before   map[string]int `json:"before"`
+	After    map[string]int `json:"after"`
+}
+
+// clone returns a copy of m with its own resources, jobs, groups and units,
+// sharing the pools, rules and balancers. Called with mux held.
+func (m *Manager) clone() *Manager {
+	c := &Manager{Identity: m.Identity,
+		Affinity: m.Affinity,
+		WarmUp:   m.WarmUp,
+		Pools:    map[string]*Pool{},
+		Rules:    m.Rules,
+		jobs:     map[JobKey]*Job{},
+		units:    map[string]*unit{},
+		tenants:  map[string]*tenantState{}}
+	for n, p := range m.Pools {
+		c.Pools[n] = p
+	}
+	for n, t := range m.tenants {
+		ts := *t
+		c.tenants[n] = &ts
+	}
+	copies := map[*Resource]*Resource{}
+	for _, r := range m.Resources {
+		rc := *r
+		rc.Jobs = map[JobKey]*Job{}
+		rc.left = make(map[string]grouping.Key, len(r.left))
+		for g, k := range r.left {
+			rc.left[g] = k
+		}
+		copies[r] = &rc
+		c.Resources = append(c.Resources, &rc)
+	}
+	for k, j := range m.jobs {
+		jc := *j
+		jc.groups = make(map[string]grouping.Key, len(j.groups))
+		for g, gk := range j.groups {
+			jc.groups[g] = gk
+		}
+		jc.series = make(map[string]int, len(j.series))
+		for g, n := range j.series {
+			jc.series[g] = n
+		}
+		jc.resource = copies[j.resource]
+		jc.resource.Jobs[k] = &jc
+		c.jobs[k] = &jc
+	}
+	for n, u := range m.units {
+		c.units[n] = &unit{resource: copies[u.resource], jobs: u.jobs}
+	}
+	return c
+}
+
+func distribution(rs []*Resource) map[string]int {
+	d := map[string]int{}
+	for _, r := range rs {
+		d[r.URL.String()] = len(r.Jobs)
+	}
+	return d
+}
+
+// WhatIf applies change to a copy of the manager with its balancers and
+// reports what would happen to the jobs. The manager itself is untouched.
+func (m *Manager) WhatIf(change Change) (WhatIf, error) {
+	m.mux.RLock()
+	c := m.clone()
+	before := distribution(m.Resources)
+	jobs := make(map[JobKey]PlannedMove, len(m.jobs))
+	for k, j := range m.jobs {
+		jobs[k] = PlannedMove{Job: k, GroupingKey: j.Key.String(), Pool: j.pool, From: j.resource.URL.String()}
+	}
+	m.mux.RUnlock()
+
+	for _, sr := range change.Add {
+		if _, err := c.addResource(sr); err != nil {
+			return WhatIf{}, err
+		}
+	}
+	for _, id := range change.Remove {
+		if _, err := c.removeResource(func(r *Resource) bool {
+			return r.URL.String() == id || (r.ID != "" && r.ID == id)
+		}); err != nil {
+			return WhatIf{}, fmt.Errorf("No resource found with url or id %v", id)
+		}
+	}
+	if change.Rebalance {
+		c.Rebalance("")
+	}
+
+	w := WhatIf{Moves: []PlannedMove{}, Unplaced: []string{}, Before: before, After: distribution(c.Resources)}
+	for k, mv := range jobs {
+		j, ok := c.jobs[k]
+		if !ok {
+			w.Unplaced = append(w.Unplaced, mv.GroupingKey)
+			continue
+		}
+		if mv.To = j.resource.URL.String(); mv.To != mv.From {
+			w.Moves = append(w.Moves, mv)
+		}
+	}
+	sort.Slice(w.Moves, func(a, b int) bool { return w.Moves[a].Job < w.Moves[b].Job })
+	sort.Strings(w.Unplaced)
+	return w, nil
+}
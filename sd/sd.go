@@ -0,0 +1,143 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bass3m/middleman/resource"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Labels of the targets we hand to Prometheus service discovery
+const (
+	IDLabel        = "__meta_middleman_resource_id"
+	ContainerLabel = "__meta_middleman_container_name"
+	PoolLabel      = "__meta_middleman_pool"
+)
+
+// TargetGroup is a group of scrape targets as Prometheus http_sd and file_sd
+// expect them
+type TargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// TargetGroups returns a target group for every healthy resource in
+// resources, labelled with labels besides our own. Resources with a path or
+// https get the matching relabelling labels.
+func TargetGroups(resources []resource.Resource, labels map[string]string) []TargetGroup {
+	groups := []TargetGroup{}
+	for _, res := range resources {
+		if res.Unhealthy {
+			continue
+		}
+		ls := map[string]string{}
+		for n, v := range labels {
+			ls[n] = v
+		}
+		ls[IDLabel] = res.ID
+		ls[ContainerLabel] = res.Name
+		ls[PoolLabel] = res.Pool
+		if res.URL.Scheme == "https" {
+			ls["__scheme__"] = "https"
+		}
+		if p := strings.TrimSuffix(res.URL.Path, "/"); p != "" {
+			ls["__metrics_path__"] = p + "/metrics"
+		}
+		groups = append(groups, TargetGroup{Targets: []string{res.URL.Host}, Labels: ls})
+	}
+	return groups
+}
+
+// FileWriter writes the resources to a Prometheus file_sd file
+type FileWriter struct {
+	path   string
+	yaml   bool
+	labels map[string]string
+}
+
+// NewFileWriter returns a writer of file_sd files at path in format, json or
+// yaml, guessed from the extension of path when empty. labels are added to
+// every target.
+func NewFileWriter(path string, format string, labels map[string]string) (*FileWriter, error) {
+	if format == "" {
+		switch filepath.Ext(path) {
+		case ".yml", ".yaml":
+			format = "yaml"
+		default:
+			format = "json"
+		}
+	}
+	if format != "json" && format != "yaml" {
+		return nil, fmt.Errorf("Unrecognized file_sd format %v", format)
+	}
+	return &FileWriter{path: path, yaml: format == "yaml", labels: labels}, nil
+}
+
+// Write replaces the file with the targets of resources. The file is written
+// to a temporary file renamed over it, so Prometheus never reads half of it.
+func (w *FileWriter) Write(resources []resource.Resource) error {
+	groups := TargetGroups(resources, w.labels)
+	var b []byte
+	var err error
+	if w.yaml {
+		b, err = yaml.Marshal(groups)
+	} else {
+		b, err = json.MarshalIndent(groups, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(w.path), "."+filepath.Base(w.path))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	// TempFile creates files only we can read
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), w.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Watch writes the file now and whenever the resources of m change, until
+// ctx is done
+func (w *FileWriter) Watch(ctx context.Context, m *resource.Manager) {
+	changes := make(chan struct{}, 1)
+	m.OnResourceChange(func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	for {
+		if err := w.Write(m.ResourceList()); err != nil {
+			log.Errorf("Failed to write file_sd file %v: %v", w.path, err)
+		} else {
+			log.Debugf("Wrote file_sd file %v", w.path)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/bass3m/middleman/grouping"
+	"github.com/bass3m/middleman/resource"
+)
+
+// simJob is a push to simulate, the client host and grouping key
+type simJob struct {
+	host string
+	key  grouping.Key
+}
+
+// readJobs reads the jobs to simulate from r, a push path per line,
+// optionally followed by the client host. Blank lines and # comments are
+// skipped.
+func readJobs(r io.Reader) ([]simJob, error) {
+	jobs := []simJob{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		k, err := grouping.ParsePath(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		j := simJob{key: k}
+		if len(fields) > 1 {
+			j.host = fields[1]
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, s.Err()
+}
+
+// syntheticJobs returns n jobs spread over a hundred job names
+func syntheticJobs(n int) []simJob {
+	jobs := make([]simJob, 0, n)
+	for i := 0; i < n; i++ {
+		k, _ := grouping.Parse(fmt.Sprintf("job%d", i%100), false, fmt.Sprintf("/instance/host%d", i))
+		jobs = append(jobs, simJob{key: k})
+	}
+	return jobs
+}
+
+// distStats summarizes how evenly jobs are spread over resources
+type distStats struct {
+	min, max     int
+	mean, stddev float64
+	gini         float64
+}
+
+func newDistStats(counts []int) distStats {
+	if len(counts) == 0 {
+		return distStats{}
+	}
+	sorted := append([]int(nil), counts...)
+	sort.Ints(sorted)
+	d := distStats{min: sorted[0], max: sorted[len(sorted)-1]}
+	total := 0
+	for _, c := range sorted {
+		total += c
+	}
+	n := float64(len(sorted))
+	d.mean = float64(total) / n
+	for _, c := range sorted {
+		d.stddev += (float64(c) - d.mean) * (float64(c) - d.mean)
+	}
+	d.stddev = math.Sqrt(d.stddev / n)
+	if total > 0 {
+		// with sorted counts the mean absolute difference is a single sum
+		weighted := 0.0
+		for i, c := range sorted {
+			weighted += float64(2*(i+1)-len(sorted)-1) * float64(c)
+		}
+		d.gini = weighted / (n * float64(total))
+	}
+	return d
+}
+
+func (d distStats) String() string {
+	return fmt.Sprintf("min %d max %d mean %.1f stddev %.2f gini %.3f", d.min, d.max, d.mean, d.stddev, d.gini)
+}
+
+// placement returns the resource of every job of m
+func placement(m *resource.Manager) map[string]string {
+	p := map[string]string{}
+	for _, js := range m.JobStats() {
+		p[js.Client+" "+js.GroupingKey] = js.Resource
+	}
+	return p
+}
+
+// churn counts the jobs of before that are on another resource, or none,
+// in after
+func churn(before, after map[string]string) int {
+	moved := 0
+	for j, r := range before {
+		if after[j] != r {
+			moved++
+		}
+	}
+	return moved
+}
+
+func counts(m *resource.Manager) []int {
+	cs := []int{}
+	for _, rs := range m.ResourceStats() {
+		cs = append(cs, rs.Jobs)
+	}
+	return cs
+}
+
+// simulate places jobs on resources with algo, then adds and removes
+// resources, and prints the distribution and churn of every step to out
+func simulate(out io.Writer, jobs []simJob, resources int, algo string, add int, remove int, rebalance bool) error {
+	if resources < 1 {
+		return fmt.Errorf("Need at least one resource")
+	}
+	if _, err := resource.NewBalancer(algo); err != nil {
+		return err
+	}
+	uri := func(i int) string { return fmt.Sprintf("http://resource%d:9091", i) }
+	rs := []resource.SvrResource{}
+	for i := 0; i < resources; i++ {
+		rs = append(rs, resource.SvrResource{URI: uri(i)})
+	}
+	m := resource.CreateBalancer(rs, algo)
+	for _, j := range jobs {
+		if _, err := m.FindResource("", j.host, j.key); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "algorithm %s, %d jobs on %d resources\n", algo, len(m.JobStats()), resources)
+	fmt.Fprintf(out, "%-24s %s\n", "initial", newDistStats(counts(m)))
+
+	step := func(name string, change func() error) error {
+		before := placement(m)
+		if err := change(); err != nil {
+			return err
+		}
+		if rebalance {
+			m.Rebalance("")
+		}
+		moved := churn(before, placement(m))
+		pct := 0.0
+		if len(before) > 0 {
+			pct = 100 * float64(moved) / float64(len(before))
+		}
+		fmt.Fprintf(out, "%-24s %s churn %d jobs (%.2f%%)\n", name, newDistStats(counts(m)), moved, pct)
+		return nil
+	}
+	if add > 0 {
+		err := step(fmt.Sprintf("add %d resources", add), func() error {
+			for i := resources; i < resources+add; i++ {
+				if err := m.AddResource(resource.SvrResource{URI: uri(i)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if remove > 0 {
+		if remove >= resources+add {
+			return fmt.Errorf("Can't remove all %d resources", resources+add)
+		}
+		err := step(fmt.Sprintf("remove %d resources", remove), func() error {
+			for i := 0; i < remove; i++ {
+				if err := m.RemoveResourceURL(uri(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runSimulate reads the jobs from path, or makes up synthetic ones when path
+// is empty, and simulates them
+func runSimulate(out io.Writer, path string, synthetic int, resources int, algo string, add int, remove int,
+	rebalance bool) error {
+	jobs := syntheticJobs(synthetic)
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if jobs, err = readJobs(f); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	return simulate(out, jobs, resources, algo, add, remove, rebalance)
+}
@@ -0,0 +1,397 @@
+package spool
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrFull is returned when a resource's spool has no room for a push
+var ErrFull = errors.New("Spool full")
+
+const (
+	recordSuffix = ".push"
+	// urlFile holds the URL of the resource a spool directory belongs to
+	urlFile    = "url"
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Record is a push waiting to be delivered
+type Record struct {
+	Method string
+	// Path is the push path on the resource, e.g. /metrics/job/foo
+	Path   string
+	Header http.Header
+	Body   []byte
+	Time   time.Time
+}
+
+// file is a spooled record on disk
+type file struct {
+	name string
+	size int64
+	time time.Time
+}
+
+// queue is the spool of one resource, its records are delivered in order
+type queue struct {
+	url     string
+	dir     string
+	client  *http.Client
+	files   []file
+	bytes   int64
+	seq     uint64
+	wake    chan struct{}
+	mux     sync.Mutex
+	spooler *Spooler
+}
+
+// Depth is the number of records and bytes spooled for a resource
+type Depth struct {
+	Records int
+	Bytes   int64
+}
+
+// Spooler keeps a write-ahead spool per resource of the pushes that could
+// not be delivered, and delivers them in order with backoff once the
+// resource is back. Records are synced to disk before they are accepted.
+type Spooler struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	queues   map[string]*queue
+	mux      sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// New returns a spooler keeping its spools under dir. maxBytes bounds the
+// spool of every resource and records older than maxAge are dropped, 0 means
+// no limit. Records spooled by an earlier run are delivered again.
+func New(dir string, maxBytes int64, maxAge time.Duration) (*Spooler, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Spooler{dir: dir, maxBytes: maxBytes, maxAge: maxAge,
+		queues: map[string]*queue{}, ctx: ctx, cancel: cancel}
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		u, err := ioutil.ReadFile(filepath.Join(dir, d.Name(), urlFile))
+		if err != nil {
+			log.Warnf("Ignoring spool directory %v: %v", d.Name(), err)
+			continue
+		}
+		q, err := s.open(string(u), &http.Client{})
+		if err != nil {
+			return nil, err
+		}
+		if len(q.files) > 0 {
+			log.Infof("Found %d spooled pushes for %v", len(q.files), q.url)
+		}
+	}
+	return s, nil
+}
+
+// open returns the queue of the resource at url, loading it from disk and
+// starting its delivery if needed
+func (s *Spooler) open(url string, client *http.Client) (*queue, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if q, ok := s.queues[url]; ok {
+		return q, nil
+	}
+	sum := sha256.Sum256([]byte(url))
+	q := &queue{url: url, dir: filepath.Join(s.dir, hex.EncodeToString(sum[:8])), client: client,
+		wake: make(chan struct{}, 1), spooler: s}
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(q.dir, urlFile), []byte(url), 0644); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range infos {
+		if !strings.HasSuffix(fi.Name(), recordSuffix) {
+			continue
+		}
+		q.files = append(q.files, file{name: fi.Name(), size: fi.Size(), time: fi.ModTime()})
+		q.bytes += fi.Size()
+		var seq uint64
+		fmt.Sscanf(fi.Name(), "%d", &seq)
+		if seq >= q.seq {
+			q.seq = seq + 1
+		}
+	}
+	sort.Slice(q.files, func(i, j int) bool { return q.files[i].name < q.files[j].name })
+	s.queues[url] = q
+	s.wg.Add(1)
+	go q.deliver(s.ctx)
+	return q, nil
+}
+
+// Enqueue spools rec for the resource at url, client being how to reach it
+func (s *Spooler) Enqueue(url string, client *http.Client, rec Record) error {
+	q, err := s.open(url, client)
+	if err != nil {
+		return err
+	}
+	return q.enqueue(rec)
+}
+
+// Pending reports whether pushes to the resource at url are waiting, new
+// pushes must then be spooled behind them to keep their order
+func (s *Spooler) Pending(url string) bool {
+	s.mux.Lock()
+	q, ok := s.queues[url]
+	s.mux.Unlock()
+	if !ok {
+		return false
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return len(q.files) > 0
+}
+
+// Move moves the records spooled for the resource at from whose path match
+// accepts to the spool of the resource at to, client being how to reach it,
+// keeping their order. With to empty they are dropped. It returns how many
+// records were moved.
+func (s *Spooler) Move(from string, to string, client *http.Client, match func(path string) bool) (int, error) {
+	if from == to {
+		return 0, nil
+	}
+	s.mux.Lock()
+	q, ok := s.queues[from]
+	s.mux.Unlock()
+	if !ok {
+		return 0, nil
+	}
+	var dst *queue
+	if to != "" {
+		var err error
+		if dst, err = s.open(to, client); err != nil {
+			return 0, err
+		}
+	}
+	files := []file{}
+	recs := []*Record{}
+	q.mux.Lock()
+	for _, f := range q.files {
+		if rec, err := q.read(f); err == nil && match(rec.Path) {
+			files = append(files, f)
+			recs = append(recs, rec)
+		}
+	}
+	q.mux.Unlock()
+	// enqueue before removing so no record is lost midway, the records left
+	// stay where they are, in order
+	moved := len(recs)
+	var err error
+	if dst != nil {
+		for i, rec := range recs {
+			if err = dst.enqueue(*rec); err != nil {
+				moved = i
+				break
+			}
+		}
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for _, f := range files[:moved] {
+		q.remove(f)
+	}
+	return moved, err
+}
+
+// Depth returns the depth of the spool of every resource
+func (s *Spooler) Depth() map[string]Depth {
+	s.mux.Lock()
+	queues := make([]*queue, 0, len(s.queues))
+	for _, q := range s.queues {
+		queues = append(queues, q)
+	}
+	s.mux.Unlock()
+	depths := map[string]Depth{}
+	for _, q := range queues {
+		q.mux.Lock()
+		depths[q.url] = Depth{Records: len(q.files), Bytes: q.bytes}
+		q.mux.Unlock()
+	}
+	return depths
+}
+
+// Close stops delivering, spooled records stay on disk for the next run
+func (s *Spooler) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (q *queue) enqueue(rec Record) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&rec); err != nil {
+		return err
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if max := q.spooler.maxBytes; max > 0 && q.bytes+int64(buf.Len()) > max {
+		return ErrFull
+	}
+	name := fmt.Sprintf("%020d%s", q.seq, recordSuffix)
+	tmp := filepath.Join(q.dir, "."+name)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(q.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	q.seq++
+	q.files = append(q.files, file{name: name, size: int64(buf.Len()), time: rec.Time})
+	q.bytes += int64(buf.Len())
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next returns the oldest record, dropping those past their age
+func (q *queue) next() (file, *Record, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for len(q.files) > 0 {
+		f := q.files[0]
+		rec, err := q.read(f)
+		if err != nil {
+			log.Errorf("Dropping unreadable spooled push %v for %v: %v", f.name, q.url, err)
+		} else if age := q.spooler.maxAge; age > 0 && time.Since(rec.Time) > age {
+			log.Warnf("Dropping spooled push %v for %v older than %v", rec.Path, q.url, age)
+		} else {
+			return f, rec, true
+		}
+		q.remove(f)
+	}
+	return file{}, nil, false
+}
+
+// read reads the record of f from disk
+func (q *queue) read(f file) (*Record, error) {
+	var rec Record
+	b, err := ioutil.ReadFile(filepath.Join(q.dir, f.name))
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(b)).Decode(&rec)
+	}
+	return &rec, err
+}
+
+// remove drops the record of f, unless it is gone already. Called with mux
+// held.
+func (q *queue) remove(f file) {
+	for i, qf := range q.files {
+		if qf.name == f.name {
+			os.Remove(filepath.Join(q.dir, f.name))
+			if i == 0 {
+				q.files = q.files[1:]
+			} else {
+				q.files = append(q.files[:i], q.files[i+1:]...)
+			}
+			q.bytes -= f.size
+			return
+		}
+	}
+}
+
+// send delivers rec, it returns whether rec is done with, delivered or
+// refused for good
+func (q *queue) send(ctx context.Context, rec *Record) bool {
+	req, err := http.NewRequest(rec.Method, q.url+rec.Path, bytes.NewReader(rec.Body))
+	if err != nil {
+		log.Errorf("Dropping spooled push %v for %v: %v", rec.Path, q.url, err)
+		return true
+	}
+	for h, v := range rec.Header {
+		req.Header[h] = v
+	}
+	resp, err := q.client.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Debugf("Failed to deliver spooled push %v to %v: %v", rec.Path, q.url, err)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		log.Debugf("Failed to deliver spooled push %v to %v: HTTP status %d", rec.Path, q.url, resp.StatusCode)
+		return false
+	}
+	if resp.StatusCode >= 300 {
+		log.Errorf("Dropping spooled push %v refused by %v: HTTP status %d", rec.Path, q.url, resp.StatusCode)
+	}
+	return true
+}
+
+// deliver sends the records in order until ctx is done, backing off while
+// the resource fails
+func (q *queue) deliver(ctx context.Context) {
+	defer q.spooler.wg.Done()
+	backoff := minBackoff
+	for {
+		f, rec, ok := q.next()
+		var wait <-chan time.Time
+		wake := q.wake
+		if ok {
+			if q.send(ctx, rec) {
+				q.mux.Lock()
+				q.remove(f)
+				q.mux.Unlock()
+				backoff = minBackoff
+				continue
+			}
+			// new pushes don't cut the backoff short
+			wait, wake = time.After(backoff), nil
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-wait:
+		}
+	}
+}
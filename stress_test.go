@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bass3m/middleman/grouping"
+	"github.com/bass3m/middleman/handler"
+	"github.com/bass3m/middleman/resource"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests in this file are meant to be run with -race, they hammer a
+// single Manager from many goroutines at once.
+
+const (
+	stressWorkers = 8
+	stressRounds  = 200
+)
+
+func stressSetup(resources int) (*resource.Manager, *httprouter.Router, *httptest.Server) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	rs := []resource.SvrResource{}
+	for i := 0; i < resources; i++ {
+		rs = append(rs, resource.SvrResource{URI: fmt.Sprintf("%s/gw%d", gw.URL, i), ID: fmt.Sprintf("gw%d", i)})
+	}
+	sm := resource.CreateBalancer(rs, "least")
+	sr := httprouter.New()
+	handler.SetupRoutes(sr, sm, "", handler.Options{})
+	return sm, sr, gw
+}
+
+func stressRequest(t *testing.T, r *httprouter.Router, method, path, remoteAddr string) {
+	req, err := http.NewRequest(method, path, strings.NewReader("some_metric 1\n"))
+	if err != nil {
+		t.Error("\tShould be able to create a request", ballotX, err)
+		return
+	}
+	req.RemoteAddr = remoteAddr
+	r.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestStressPushDelete(t *testing.T) {
+	sm, sr, gw := stressSetup(4)
+	defer gw.Close()
+
+	t.Log("Given the need to push and delete jobs concurrently.")
+	var wg sync.WaitGroup
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			addr := fmt.Sprintf("10.0.0.%d:4242", w)
+			for i := 0; i < stressRounds; i++ {
+				path := fmt.Sprintf("/metrics/job/stress/instance/host%d", i%10)
+				stressRequest(t, sr, "PUT", path, addr)
+				if i%3 == 0 {
+					stressRequest(t, sr, "DELETE", path, addr)
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < stressRounds; i++ {
+			sm.JobStats()
+			sm.ResourceStats()
+			k, _ := grouping.ParsePath("/metrics/job/stress/instance/host0")
+			sm.JobExists("", "10.0.0.0", k)
+		}
+	}()
+	wg.Wait()
+
+	jobs := 0
+	for _, rs := range sm.ResourceStats() {
+		jobs += rs.Jobs
+	}
+	if jobs != len(sm.JobStats()) {
+		t.Fatal("\tResources and job index should agree", ballotX, jobs, len(sm.JobStats()))
+	}
+	t.Log("\tResources and job index should agree", checkMark)
+}
+
+func TestStressResourceChurn(t *testing.T) {
+	sm, sr, gw := stressSetup(2)
+	defer gw.Close()
+
+	t.Log("Given the need to push while resources come and go.")
+	var wg sync.WaitGroup
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			addr := fmt.Sprintf("10.0.1.%d:4242", w)
+			for i := 0; i < stressRounds; i++ {
+				stressRequest(t, sr, "PUT", fmt.Sprintf("/metrics/job/churn/instance/host%d", i%25), addr)
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < stressRounds; i++ {
+			id := fmt.Sprintf("churn%d", i%5)
+			if err := sm.AddResource(resource.SvrResource{URI: fmt.Sprintf("%s/%s", gw.URL, id), ID: id}); err != nil {
+				sm.RemoveResource(id)
+			}
+		}
+	}()
+	wg.Wait()
+
+	jobs := 0
+	for _, rs := range sm.ResourceStats() {
+		jobs += rs.Jobs
+	}
+	if jobs != len(sm.JobStats()) {
+		t.Fatal("\tResources and job index should agree", ballotX, jobs, len(sm.JobStats()))
+	}
+	t.Log("\tResources and job index should agree", checkMark)
+}
+
+func TestStressWhatIf(t *testing.T) {
+	sm, sr, gw := stressSetup(3)
+	defer gw.Close()
+	// every group of the job belongs to the same job, so pushes add groups to
+	// jobs the what-if copies
+	identity, err := resource.NewIdentity("job", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Identity = identity
+
+	t.Log("Given the need to try out changes while jobs are pushed.")
+	var wg sync.WaitGroup
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			addr := fmt.Sprintf("10.0.2.%d:4242", w)
+			for i := 0; i < stressRounds; i++ {
+				stressRequest(t, sr, "PUT", fmt.Sprintf("/metrics/job/whatif%d/instance/host%d", i%3, i), addr)
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	tried := make(chan struct{})
+	go func() {
+		defer close(tried)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			if _, err := sm.WhatIf(resource.Change{Remove: []string{fmt.Sprintf("gw%d", i%3)}}); err != nil {
+				t.Error("\tShould be able to try out removing a resource", ballotX, err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	<-tried
+	t.Log("\tShould be able to try out removing a resource", checkMark)
+}
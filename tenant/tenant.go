@@ -0,0 +1,178 @@
+package tenant
+
+import (
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways of identifying the tenant of a request
+const (
+	// ByHeader reads the tenant name from a request header
+	ByHeader = "header"
+	// ByPath reads the tenant name from the :tenant route param
+	ByPath = "path"
+	// ByToken maps the bearer token of the request to a tenant
+	ByToken = "token"
+)
+
+// DefaultHeader is the header read by ByHeader when none is configured
+const DefaultHeader = "X-Middleman-Tenant"
+
+// Tenant is a team sharing middleman. Its jobs go to its own pool, MaxJobs
+// bounds its job count and its pushes are rate limited, 0 means no limit.
+type Tenant struct {
+	Name     string
+	Token    string
+	Pool     string
+	MaxJobs  int
+	PushRate float64
+	limiter  *limiter
+}
+
+// Allow reports whether the tenant may push now, and if not how long until
+// it may
+func (t *Tenant) Allow() (bool, time.Duration) {
+	if t.limiter == nil {
+		return true, 0
+	}
+	return t.limiter.allow(time.Now())
+}
+
+// limiter is a token bucket refilled at rate tokens per second
+type limiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mux    sync.Mutex
+}
+
+func (l *limiter) allow(now time.Time) (bool, time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// Registry identifies the tenant of requests. A nil Registry means tenants
+// are disabled, every request then belongs to no tenant.
+type Registry struct {
+	identifyBy string
+	header     string
+	adminToken string
+	tenants    map[string]*Tenant
+	tokens     map[string]*Tenant
+}
+
+// NewRegistry returns a registry identifying tenants by identifyBy. Requests
+// bearing adminToken see every tenant in the admin API.
+func NewRegistry(identifyBy string, header string, adminToken string) (*Registry, error) {
+	switch identifyBy {
+	case ByHeader, ByPath, ByToken:
+	default:
+		return nil, fmt.Errorf("Unrecognized tenant identification %v", identifyBy)
+	}
+	if header == "" {
+		header = DefaultHeader
+	}
+	return &Registry{identifyBy: identifyBy,
+		header:     header,
+		adminToken: adminToken,
+		tenants:    map[string]*Tenant{},
+		tokens:     map[string]*Tenant{}}, nil
+}
+
+// Add registers t, pushBurst is the number of pushes it may make at once
+func (r *Registry) Add(t *Tenant, pushBurst int) error {
+	if t.Name == "" {
+		return fmt.Errorf("Tenant without a name")
+	}
+	if _, ok := r.tenants[t.Name]; ok {
+		return fmt.Errorf("Tenant %v already exists", t.Name)
+	}
+	if r.identifyBy == ByToken {
+		if t.Token == "" {
+			return fmt.Errorf("Tenant %v has no token", t.Name)
+		}
+		if _, ok := r.tokens[t.Token]; ok {
+			return fmt.Errorf("Tenant %v reuses another tenant's token", t.Name)
+		}
+		r.tokens[t.Token] = t
+	}
+	if t.PushRate > 0 {
+		if pushBurst < 1 {
+			pushBurst = 1
+		}
+		t.limiter = &limiter{rate: t.PushRate, burst: float64(pushBurst),
+			tokens: float64(pushBurst), last: time.Now()}
+	}
+	r.tenants[t.Name] = t
+	return nil
+}
+
+// Header is the header naming the tenant of requests in ByHeader mode
+func (r *Registry) Header() string {
+	return r.header
+}
+
+// ByPath reports whether tenants are named in the route path
+func (r *Registry) ByPath() bool {
+	return r != nil && r.identifyBy == ByPath
+}
+
+// BearerToken returns the bearer token of the Authorization header of req
+func BearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// Admin reports whether req carries the admin token, which sees every tenant
+func (r *Registry) Admin(req *http.Request) bool {
+	return r == nil || (r.adminToken != "" && BearerToken(req) == r.adminToken)
+}
+
+// Identify returns the tenant of req, nil when tenants are disabled
+func (r *Registry) Identify(req *http.Request, ps httprouter.Params) (*Tenant, error) {
+	if r == nil {
+		return nil, nil
+	}
+	switch r.identifyBy {
+	case ByToken:
+		token := BearerToken(req)
+		if token == "" {
+			return nil, fmt.Errorf("Missing bearer token")
+		}
+		if t, ok := r.tokens[token]; ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("Unknown tenant token")
+	case ByPath:
+		return r.lookup(ps.ByName("tenant"))
+	}
+	return r.lookup(req.Header.Get(r.header))
+}
+
+func (r *Registry) lookup(name string) (*Tenant, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Missing tenant")
+	}
+	if t, ok := r.tenants[name]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("Unknown tenant %v", name)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/bass3m/middleman/resource"
+)
+
+// runWhatIf asks the middleman at url what change would do and prints the
+// answer to out
+func runWhatIf(out io.Writer, url string, adminToken string, change resource.Change) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(url, "/")+"/admin/whatif", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var result resource.WhatIf
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	printWhatIf(out, result)
+	return nil
+}
+
+func printWhatIf(out io.Writer, w resource.WhatIf) {
+	fmt.Fprintf(out, "%d jobs move, %d left without a resource\n", len(w.Moves), len(w.Unplaced))
+	for _, mv := range w.Moves {
+		fmt.Fprintf(out, "  %s: %s -> %s\n", mv.GroupingKey, mv.From, mv.To)
+	}
+	for _, k := range w.Unplaced {
+		fmt.Fprintf(out, "  %s: unplaced\n", k)
+	}
+	urls := []string{}
+	for u := range w.Before {
+		urls = append(urls, u)
+	}
+	for u := range w.After {
+		if _, ok := w.Before[u]; !ok {
+			urls = append(urls, u)
+		}
+	}
+	sort.Strings(urls)
+	fmt.Fprintf(out, "%-40s %8s %8s\n", "RESOURCE", "BEFORE", "AFTER")
+	for _, u := range urls {
+		before, after := "-", "-"
+		if n, ok := w.Before[u]; ok {
+			before = fmt.Sprint(n)
+		}
+		if n, ok := w.After[u]; ok {
+			after = fmt.Sprint(n)
+		}
+		fmt.Fprintf(out, "%-40s %8s %8s\n", u, before, after)
+	}
+}